@@ -0,0 +1,324 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BroadcastBuffer is a ring buffer with one producer and any number of named consumers,
+// each of which sees every byte written. Every consumer has its own sequence, and the
+// producer only overwrites what the slowest of them is done with, so one copy of the
+// stream can feed, e.g., a logger, a metrics tap and a router.
+//
+// BroadcastBuffer itself only has the producer side. The consumers are added with
+// AddConsumer, and each of them can be read like any other RingBuffer. Consumers can
+// also depend on other consumers, like the stages of a pipeline, in which case they
+// only see the bytes those consumers are done with.
+type BroadcastBuffer struct {
+	buf *Buffer
+
+	o *options
+
+	mu        sync.Mutex
+	consumers map[string]*BroadcastConsumer
+}
+
+// BroadcastConsumer is a consumer of a BroadcastBuffer. It has the whole consumer side
+// of a RingBuffer, but none of the producer side, which returns ErrBufferUnsupported.
+type BroadcastConsumer struct {
+	*Buffer
+
+	name string
+}
+
+var _ RingBuffer = (*BroadcastConsumer)(nil)
+
+// NewBroadcastBuffer creates a BroadcastBuffer of the given size. It waits with a
+// YieldingWait, unless opts choose another WaitStrategy with WithWaitStrategy. opts can
+// also set the block sizes. The size and kind always come from NewBroadcastBuffer.
+func NewBroadcastBuffer(size int64, opts ...Option) (*BroadcastBuffer, error) {
+	o, err := newOptions(append(opts[:len(opts):len(opts)], WithSize(size), WithKind(LockFreeKind))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBroadcastBuffer(o), nil
+}
+
+func newBroadcastBuffer(o *options) *BroadcastBuffer {
+	this := &BroadcastBuffer{
+		buf:       newBuffer(o),
+		o:         o,
+		consumers: make(map[string]*BroadcastConsumer),
+	}
+
+	// Until there are consumers, nothing waits to read the data.
+	this.buf.readers.Store([]*Buffer{})
+
+	return this
+}
+
+// AddConsumer adds a consumer called name, which sees everything written to the buffer
+// from the start. Consumers must be added before anything is written, so none of them
+// can miss any data.
+//
+// If deps are given, the consumer only sees the bytes that all of the consumers named
+// by deps have read or committed, and aren't holding on to. E.g., for a decode ->
+// validate -> persist pipeline, add "decode", then "validate" depending on "decode",
+// then "persist" depending on "validate". Since the consumers in deps must already
+// exist, there can't be any cycles.
+func (this *BroadcastBuffer) AddConsumer(name string, deps ...string) (*BroadcastConsumer, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.buf.pseq.getClaim() != 0 {
+		return nil, fmt.Errorf("Consumer %q must be added before writing starts.", name)
+	}
+
+	if _, ok := this.consumers[name]; ok {
+		return nil, fmt.Errorf("Consumer %q already exists.", name)
+	}
+
+	barrier := make([]*Buffer, 0, len(deps))
+
+	for _, dep := range deps {
+		d, ok := this.consumers[dep]
+		if !ok {
+			return nil, fmt.Errorf("Consumer %q doesn't exist.", dep)
+		}
+
+		barrier = append(barrier, d.Buffer)
+	}
+
+	// The consumer is a Buffer that shares the data, the producer sequence and the
+	// WaitStrategy, but has a consumer sequence of its own.
+	c := &BroadcastConsumer{
+		Buffer: &Buffer{
+			id:   atomic.AddInt32(&bufcnt, 1),
+			buf:  this.buf.buf,
+			size: this.buf.size,
+			mask: this.buf.mask,
+			pseq: this.buf.pseq,
+			cseq: newSequence(),
+
+			waiter: this.buf.waiter,
+			root:   this.buf,
+
+			held:         -1,
+			lastByte:     -1,
+			lastRuneSize: -1,
+			marked:       -1,
+			pinned:       -1,
+
+			rbsize:  this.o.readBlockSize,
+			wbsize:  this.o.writeBlockSize,
+			maxread: int64(this.o.maxReadSize),
+
+			deps: barrier,
+		},
+		name: name,
+	}
+
+	this.consumers[name] = c
+
+	readers := this.buf.readers.Load().([]*Buffer)
+	readers = append(readers[:len(readers):len(readers)], c.Buffer)
+	this.buf.readers.Store(readers)
+
+	return c, nil
+}
+
+// Consumer returns the consumer called name, or nil if there isn't one.
+func (this *BroadcastBuffer) Consumer(name string) *BroadcastConsumer {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.consumers[name]
+}
+
+func (this *BroadcastBuffer) ID() int32 {
+	return this.buf.ID()
+}
+
+// Close closes the buffer, and all of its consumers.
+func (this *BroadcastBuffer) Close() error {
+	this.buf.Close()
+
+	for _, r := range this.buf.readers.Load().([]*Buffer) {
+		r.Close()
+	}
+
+	return nil
+}
+
+// CloseWrite signals the end of the stream to all the consumers. Each of them can still
+// read everything that has been written, and only gets io.EOF after that.
+func (this *BroadcastBuffer) CloseWrite() error {
+	return this.CloseWithError(nil)
+}
+
+// CloseWithError is like CloseWrite, except the consumers get err instead of io.EOF
+// once they have read everything.
+func (this *BroadcastBuffer) CloseWithError(err error) error {
+	this.buf.CloseWithError(err)
+
+	for _, r := range this.buf.readers.Load().([]*Buffer) {
+		r.CloseWithError(err)
+	}
+
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes, see Buffer.SetWriteDeadline.
+func (this *BroadcastBuffer) SetWriteDeadline(t time.Time) error {
+	return this.buf.SetWriteDeadline(t)
+}
+
+// Writable returns a channel that's closed once there's space to write, see
+// Buffer.Writable.
+func (this *BroadcastBuffer) Writable() <-chan struct{} {
+	return this.buf.Writable()
+}
+
+// Done returns a channel that's closed once the buffer is closed, see Buffer.Done.
+func (this *BroadcastBuffer) Done() <-chan struct{} {
+	return this.buf.Done()
+}
+
+func (this *BroadcastBuffer) Cap() int {
+	return this.buf.Cap()
+}
+
+// Free returns the number of bytes that can be written without waiting for the slowest
+// consumer.
+func (this *BroadcastBuffer) Free() int {
+	return this.buf.Free()
+}
+
+func (this *BroadcastBuffer) Produced() int64 {
+	return this.buf.Produced()
+}
+
+func (this *BroadcastBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return this.buf.ReadFrom(r)
+}
+
+func (this *BroadcastBuffer) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	return this.buf.ReadFromContext(ctx, r)
+}
+
+func (this *BroadcastBuffer) Write(p []byte) (int, error) {
+	return this.buf.Write(p)
+}
+
+func (this *BroadcastBuffer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	return this.buf.WriteContext(ctx, p)
+}
+
+func (this *BroadcastBuffer) TryWrite(p []byte) (int, error) {
+	return this.buf.TryWrite(p)
+}
+
+func (this *BroadcastBuffer) WriteString(s string) (int, error) {
+	return this.buf.WriteString(s)
+}
+
+func (this *BroadcastBuffer) WriteByte(c byte) error {
+	return this.buf.WriteByte(c)
+}
+
+func (this *BroadcastBuffer) WriteRune(r rune) (int, error) {
+	return this.buf.WriteRune(r)
+}
+
+func (this *BroadcastBuffer) Reserve(n int) ([][]byte, error) {
+	return this.buf.Reserve(n)
+}
+
+func (this *BroadcastBuffer) Publish(n int) (int, error) {
+	return this.buf.Publish(n)
+}
+
+// Name returns the name the consumer was added with.
+func (this *BroadcastConsumer) Name() string {
+	return this.name
+}
+
+// Close detaches the consumer, so the producer, and any consumers that depend on it,
+// stop waiting for it. Nothing should be read from it after that, since the producer
+// may be overwriting the data.
+func (this *BroadcastConsumer) Close() error {
+	return this.Buffer.Close()
+}
+
+// The producer side is only available through the BroadcastBuffer, so all of the
+// methods below return ErrBufferUnsupported, or do nothing.
+
+func (this *BroadcastConsumer) ReadFrom(r io.Reader) (int64, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) Write(p []byte) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) TryWrite(p []byte) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) WriteString(s string) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) WriteByte(c byte) error {
+	return ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) WriteRune(r rune) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) Reserve(n int) ([][]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) Publish(n int) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) CloseWrite() error {
+	return ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) CloseWithError(err error) error {
+	return ErrBufferUnsupported
+}
+
+func (this *BroadcastConsumer) Reset() {
+}
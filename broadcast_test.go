@@ -0,0 +1,248 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestBroadcastBufferConsumers(t *testing.T) {
+	buf, err := NewBroadcastBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	names := []string{"logger", "metrics", "router"}
+
+	for _, name := range names {
+		_, err := buf.AddConsumer(name)
+
+		assert.NoError(t, true, err)
+	}
+
+	_, err = buf.AddConsumer("router")
+
+	assert.Error(t, true, err)
+
+	p := make([]byte, 10000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	go func() {
+		n, err := buf.Write(p)
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, 10000, n)
+
+		buf.CloseWrite()
+	}()
+
+	// Every consumer should see every byte, no matter how fast it reads
+	var wg sync.WaitGroup
+
+	for _, name := range names {
+		wg.Add(1)
+
+		go func(c *BroadcastConsumer) {
+			defer wg.Done()
+
+			var out bytes.Buffer
+
+			n, err := c.WriteTo(&out)
+
+			assert.Equal(t, true, io.EOF, err)
+			assert.Equal(t, true, int64(10000), n)
+			assert.Equal(t, true, p, out.Bytes())
+		}(buf.Consumer(name))
+	}
+
+	wg.Wait()
+
+	_, err = buf.AddConsumer("late")
+
+	assert.Error(t, true, err)
+}
+
+func TestBroadcastBufferSlowestConsumer(t *testing.T) {
+	buf, err := NewBroadcastBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	fast, err := buf.AddConsumer("fast")
+
+	assert.NoError(t, true, err)
+
+	slow, err := buf.AddConsumer("slow")
+
+	assert.NoError(t, true, err)
+
+	_, err = fast.Write(make([]byte, 10))
+
+	assert.Equal(t, true, ErrBufferUnsupported, err)
+
+	n, err := buf.Write(make([]byte, 1000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1000, n)
+
+	m, err := fast.Discard(1000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1000, m)
+
+	// The producer still has to wait for the slow consumer
+	assert.Equal(t, true, 3096, buf.Free())
+
+	m, err = slow.Discard(400)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 400, m)
+	assert.Equal(t, true, 3496, buf.Free())
+
+	// Once it's detached, only the fast consumer counts
+	slow.Close()
+
+	assert.Equal(t, true, 4096, buf.Free())
+	assert.Equal(t, true, 0, fast.Len())
+}
+
+func TestBroadcastBufferDependencies(t *testing.T) {
+	buf, err := NewBroadcastBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	decode, err := buf.AddConsumer("decode")
+
+	assert.NoError(t, true, err)
+
+	validate, err := buf.AddConsumer("validate", "decode")
+
+	assert.NoError(t, true, err)
+
+	persist, err := buf.AddConsumer("persist", "validate")
+
+	assert.NoError(t, true, err)
+
+	_, err = buf.AddConsumer("audit", "missing")
+
+	assert.Error(t, true, err)
+
+	n, err := buf.WriteString("hello world\n")
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 12, n)
+
+	// Nothing is visible down the pipeline until decode is done with it
+	_, err = validate.TryRead(make([]byte, 10))
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+
+	p := make([]byte, 12)
+
+	n, err = decode.Read(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "hello world\n", string(p[:n]))
+	assert.Equal(t, true, 12, validate.Len())
+	assert.Equal(t, true, 0, persist.Len())
+
+	// A held slice isn't done with yet
+	_, err = buf.WriteString("foo\n")
+
+	assert.NoError(t, true, err)
+
+	_, err = decode.ReadSlice('\n')
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 12, validate.Len())
+
+	_, err = decode.Commit(0)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 16, validate.Len())
+
+	// Closing the buffer doesn't cut the pipeline short
+	buf.CloseWrite()
+
+	done := make(chan []byte)
+
+	go func() {
+		var out bytes.Buffer
+
+		_, err := persist.WriteTo(&out)
+
+		assert.Equal(t, true, io.EOF, err)
+
+		done <- out.Bytes()
+	}()
+
+	m, err := validate.Discard(16)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 16, m)
+
+	_, err = validate.ReadByte()
+
+	assert.Equal(t, true, io.EOF, err)
+
+	assert.Equal(t, true, []byte("hello world\nfoo\n"), <-done)
+}
+
+func TestBroadcastBufferReadiness(t *testing.T) {
+	buf, err := NewBroadcastBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	first, err := buf.AddConsumer("first")
+
+	assert.NoError(t, true, err)
+
+	second, err := buf.AddConsumer("second", "first")
+
+	assert.NoError(t, true, err)
+
+	n, err := buf.Write(make([]byte, 4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, n)
+	assert.True(t, true, fired(first.Readable(), 0))
+
+	readable := second.Readable()
+	writable := buf.Writable()
+
+	// The second consumer has to wait for the first, and the producer for both
+	_, err = first.Discard(100)
+
+	assert.NoError(t, true, err)
+	assert.True(t, true, fired(readable, time.Second))
+	assert.False(t, true, fired(writable, 10*time.Millisecond))
+
+	_, err = second.Discard(100)
+
+	assert.NoError(t, true, err)
+	assert.True(t, true, fired(writable, time.Second))
+	assert.False(t, true, fired(first.Done(), 0))
+
+	buf.CloseWrite()
+
+	assert.True(t, true, fired(first.Done(), 0))
+	assert.True(t, true, fired(buf.Done(), 0))
+}
@@ -15,8 +15,13 @@
 package ringbuffer2
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"io"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -30,13 +35,63 @@ type RingBuffer interface {
 	Read(p []byte) (int, error)
 	Write(p []byte) (int, error)
 
+	io.StringWriter
+	io.ByteWriter
+	WriteRune(r rune) (int, error)
+
+	io.ByteScanner
+	io.RuneScanner
+	ReadSlice(delim byte) ([]byte, error)
+	ReadLine() ([]byte, bool, error)
+	ReadBytes(delim byte) ([]byte, error)
+	ReadString(delim byte) (string, error)
+
 	Peek(n int) ([]byte, error)
+	PeekVec(n int) (net.Buffers, error)
 	Commit(n int) (int, error)
+	Discard(n int) (int, error)
+
+	io.ReaderAt
+
+	Mark() int64
+	Rewind(mark int64) error
+	Unmark(mark int64) error
+
+	Reserve(n int) ([][]byte, error)
+	Publish(n int) (int, error)
+
+	ReadFromContext(ctx context.Context, r io.Reader) (int64, error)
+	ReadContext(ctx context.Context, p []byte) (int, error)
+	WriteContext(ctx context.Context, p []byte) (int, error)
+	PeekContext(ctx context.Context, n int) ([]byte, error)
+
+	TryRead(p []byte) (int, error)
+	TryWrite(p []byte) (int, error)
+	TryPeek(n int) ([]byte, error)
+
+	OnHighWater(threshold int, fn func())
+	OnLowWater(threshold int, fn func())
+
+	Readable() <-chan struct{}
+	Writable() <-chan struct{}
+	Done() <-chan struct{}
+
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 
 	Len() int
+	Cap() int
+	Free() int
+	Produced() int64
+	Consumed() int64
 	ID() int32
 
+	Reset()
+
 	Close() error
+	CloseWrite() error
+	CloseWithError(err error) error
 }
 
 const (
@@ -47,18 +102,85 @@ const (
 
 var (
 	ErrBufferInsufficientData error = errors.New("RingBuffer: Insufficient data.")
+
+	// ErrBufferInsufficientReserve is returned by Publish when publishing more than
+	// what was reserved.
+	ErrBufferInsufficientReserve error = errors.New("RingBuffer: Insufficient reserved space.")
+
+	// ErrBufferInvalidMark is returned by Rewind and Unmark when the mark isn't active.
+	ErrBufferInvalidMark error = errors.New("RingBuffer: Invalid mark.")
+
+	// ErrBufferOverwritten is returned by ReadAt when the producer has already
+	// overwritten the data.
+	ErrBufferOverwritten error = errors.New("RingBuffer: Data has been overwritten.")
+
+	// ErrBufferUnsupported is returned by operations a buffer variant can't support,
+	// e.g., Reserve on a MultiProducerBuffer.
+	ErrBufferUnsupported error = errors.New("RingBuffer: Operation not supported.")
+
+	// ErrBufferWouldBlock is returned by the Try methods when the operation can't be
+	// completed without waiting.
+	ErrBufferWouldBlock error = errors.New("RingBuffer: Operation would block.")
+
+	// ErrBufferTimeout is returned when a read or write deadline passes while waiting.
+	// It satisfies net.Error, with Timeout() returning true.
+	ErrBufferTimeout error = timeoutError{}
 )
 
-func readFrom(buf RingBuffer, r io.Reader) (int64, error) {
+var _ net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "RingBuffer: I/O timeout." }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// closeError records the error the producer closed a buffer with. Only the first one
+// sticks.
+type closeError struct {
+	// 0 = open, 1 = closing, 2 = closed
+	state int32
+	err   error
+}
+
+func (this *closeError) close(err error) {
+	if atomic.CompareAndSwapInt32(&this.state, 0, 1) {
+		this.err = err
+		atomic.StoreInt32(&this.state, 2)
+	}
+}
+
+// get returns the error the buffer was closed with, or nil if it's still open.
+func (this *closeError) get() error {
+	if atomic.LoadInt32(&this.state) == 2 {
+		return this.err
+	}
+
+	return nil
+}
+
+// deadlineNano converts a deadline to nanoseconds since the epoch. The zero time, which
+// means no deadline, becomes 0.
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// readFrom reads from r a block of size bytes at a time, and writes each block to buf as
+// a whole. It's for buffers that can't let r read straight into buffer space.
+func readFrom(ctx context.Context, buf RingBuffer, r io.Reader, size int) (int64, error) {
 	total := int64(0)
-	p := make([]byte, defaultReadBlockSize)
+	p := make([]byte, size)
 
 	for {
 		n, err := r.Read(p)
 		//glog.Debugf("%d: Read %d bytes", buf.ID(), n)
 
 		if n > 0 {
-			m, err := buf.Write(p[:n])
+			m, err := buf.WriteContext(ctx, p[:n])
 			//glog.Debugf("Wrote %d bytes", m)
 			total += int64(m)
 
@@ -76,11 +198,11 @@ func readFrom(buf RingBuffer, r io.Reader) (int64, error) {
 	return total, nil
 }
 
-func writeTo(buf RingBuffer, w io.Writer) (int64, error) {
+func writeTo(buf RingBuffer, w io.Writer, n int) (int64, error) {
 	total := int64(0)
 
 	for {
-		p, err := buf.Peek(defaultWriteBlockSize)
+		p, err := buf.Peek(n)
 
 		// There's some data, let's process it first
 		if len(p) > 0 {
@@ -104,6 +226,55 @@ func writeTo(buf RingBuffer, w io.Writer) (int64, error) {
 	return total, nil
 }
 
+// readLine is the same as bufio.Reader.ReadLine, except it reads from buf.
+func readLine(buf RingBuffer) ([]byte, bool, error) {
+	line, err := buf.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Handle the case where "\r\n" straddles the buffer. Put the '\r' back and
+		// let the next call to ReadLine check for "\r\n".
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			buf.UnreadByte()
+			line = line[:len(line)-1]
+		}
+
+		return line, true, nil
+	}
+
+	if len(line) == 0 {
+		if err != nil {
+			line = nil
+		}
+
+		return line, false, err
+	}
+
+	if line[len(line)-1] == '\n' {
+		drop := 1
+		if len(line) > 1 && line[len(line)-2] == '\r' {
+			drop = 2
+		}
+
+		line = line[:len(line)-drop]
+	}
+
+	return line, false, nil
+}
+
+// readBytes reads from buf until the first delim, going past ErrBufferFull, and
+// returns a copy of what it read.
+func readBytes(buf RingBuffer, delim byte) ([]byte, error) {
+	var full []byte
+
+	for {
+		p, err := buf.ReadSlice(delim)
+		full = append(full, p...)
+
+		if err != bufio.ErrBufferFull {
+			return full, err
+		}
+	}
+}
+
 func ringCopy(dst, src []byte, start int64) int {
 	n := len(src)
 
@@ -121,3 +292,15 @@ func ringCopy(dst, src []byte, start int64) int {
 
 	return i
 }
+
+// ringRead is the reverse of ringCopy. It fills dst from the ring buffer src, starting
+// at index start and wrapping around the end of src if needed.
+func ringRead(dst, src []byte, start int64) int {
+	n := copy(dst, src[start:])
+
+	if n < len(dst) {
+		n += copy(dst[n:], src)
+	}
+
+	return n
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dataence/bithacks"
+)
+
+// EventHandler handles an entry of an EventRing. endOfBatch is true for the last entry
+// that was available when the batch started, which is a good time to, e.g., flush a
+// writer. The entry is only valid until the handler returns.
+type EventHandler[E any] func(entry *E, seq int64, endOfBatch bool)
+
+// EventRing is a ring of entries that are allocated once up front and then reused, in
+// the style of the LMAX Disruptor. A producer claims the sequence of the next entry with
+// Next, fills in the entry returned by Get in place, and then makes it visible with
+// Publish. Any number of goroutines can produce at the same time. Each EventProcessor
+// added with AddHandler sees every entry, in order, and the producers only reuse an
+// entry once all of them are done with it.
+type EventRing[E any] struct {
+	entries []E
+
+	size int64
+	mask int64
+
+	done int64
+
+	// The cursor is the sequence up to which entries are published, and the claim the
+	// one up to which they are handed out by Next.
+	pseq *sequence
+
+	// For each entry, the sequence it was last published with, or -1, so the cursor
+	// can move over entries published out of order, see Publish
+	published []int64
+
+	// How the producers and processors wait for each other
+	waiter WaitStrategy
+
+	mu sync.Mutex
+
+	// Sequences of the processors, as a []*sequence, see gate
+	handlers atomic.Value
+}
+
+// EventProcessor runs an EventHandler over the entries of an EventRing, see Run.
+type EventProcessor[E any] struct {
+	ring    *EventRing[E]
+	handler EventHandler[E]
+
+	// The sequence of the next entry to handle
+	seq *sequence
+}
+
+// NewEventRing creates an EventRing with size entries, which must be a power of two.
+// Each entry is created by calling factory. If wait is nil, it waits with a
+// YieldingWait.
+func NewEventRing[E any](size int64, factory func() E, wait WaitStrategy) (*EventRing[E], error) {
+	if size <= 0 || !bithacks.PowerOfTwo64(size) {
+		return nil, fmt.Errorf("Size must be power of two. Try %d.", bithacks.RoundUpPowerOfTwo64(size))
+	}
+
+	if wait == nil {
+		wait = NewYieldingWait()
+	}
+
+	this := &EventRing[E]{
+		entries:   make([]E, size),
+		size:      size,
+		mask:      size - 1,
+		pseq:      newSequence(),
+		published: make([]int64, size),
+		waiter:    wait,
+	}
+
+	for i := range this.entries {
+		this.entries[i] = factory()
+		this.published[i] = -1
+	}
+
+	this.handlers.Store([]*sequence{})
+
+	return this, nil
+}
+
+// AddHandler adds an EventProcessor that calls h for every entry. Handlers must be added
+// before the first call to Next, so none of them can miss any entries.
+func (this *EventRing[E]) AddHandler(h EventHandler[E]) (*EventProcessor[E], error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.pseq.getClaim() != 0 {
+		return nil, fmt.Errorf("Handlers must be added before the first event.")
+	}
+
+	p := &EventProcessor[E]{
+		ring:    this,
+		handler: h,
+		seq:     newSequence(),
+	}
+
+	handlers := this.handlers.Load().([]*sequence)
+	handlers = append(handlers[:len(handlers):len(handlers)], p.seq)
+	this.handlers.Store(handlers)
+
+	return p, nil
+}
+
+// Cap returns the number of entries.
+func (this *EventRing[E]) Cap() int {
+	return int(this.size)
+}
+
+// Close closes the ring. Next returns io.ErrClosedPipe after that, and the processors
+// return from Run once they have handled everything published before. It should only
+// be called once the producers are done, so nothing is claimed but left unpublished.
+func (this *EventRing[E]) Close() error {
+	atomic.StoreInt64(&this.done, 1)
+	this.waiter.Signal()
+	return nil
+}
+
+// Next claims the next entry for the calling producer, waiting for the processors to be
+// done with it if needed, and returns its sequence. The producer must fill in the entry
+// returned by Get, and then call Publish with the sequence.
+func (this *EventRing[E]) Next() (int64, error) {
+	for {
+		if atomic.LoadInt64(&this.done) == 1 {
+			return 0, io.ErrClosedPipe
+		}
+
+		seq := this.pseq.getClaim()
+		wrap := seq + 1 - this.size
+
+		if wrap > this.gate() {
+			err := this.wait(func() bool {
+				return wrap <= this.gate()
+			})
+			if err != nil {
+				return 0, io.ErrClosedPipe
+			}
+		}
+
+		// If another producer got here first, start over from its claim.
+		if this.pseq.casClaim(seq, seq+1) {
+			return seq, nil
+		}
+	}
+}
+
+// Get returns the entry for seq. It's only valid for a sequence returned by Next until
+// it's published, or within an EventHandler.
+func (this *EventRing[E]) Get(seq int64) *E {
+	return &this.entries[seq&this.mask]
+}
+
+// Publish makes the entry for seq visible to the processors, once all the entries
+// claimed before it have been published. Entries can be published in any order, even
+// by the same producer, and Publish never waits.
+func (this *EventRing[E]) Publish(seq int64) {
+	atomic.StoreInt64(&this.published[seq&this.mask], seq)
+
+	// Move the cursor over every entry published in a row, including the ones other
+	// producers published before us but couldn't move it over yet. If one of them
+	// moves it first, the CAS fails and we look again.
+	for {
+		cursor := this.pseq.get()
+		if atomic.LoadInt64(&this.published[cursor&this.mask]) != cursor {
+			break
+		}
+
+		this.pseq.cas(cursor, cursor+1)
+	}
+
+	this.waiter.Signal()
+}
+
+// gate returns the sequence of the slowest processor, which is where the producers
+// have to stop. Without any processors, nothing has to wait.
+func (this *EventRing[E]) gate() int64 {
+	gate := this.pseq.get()
+
+	for _, seq := range this.handlers.Load().([]*sequence) {
+		if s := seq.get(); s < gate {
+			gate = s
+		}
+	}
+
+	return gate
+}
+
+// wait waits until ready returns true, or returns io.EOF if the ring is closed before
+// that.
+func (this *EventRing[E]) wait(ready func() bool) error {
+	return waitOrDone(this.waiter, &this.done, ready)
+}
+
+// Run calls the handler for every published entry, in order, a batch at a time, until
+// the ring is closed and everything published before that is handled. It's meant to run
+// in its own goroutine, one for each processor.
+func (this *EventProcessor[E]) Run() error {
+	ring := this.ring
+	next := this.seq.get()
+
+	for {
+		var avail int64
+
+		err := ring.wait(func() bool {
+			avail = ring.pseq.get()
+			return avail > next
+		})
+
+		// If we got here because of Close, everything published before it is visible by
+		// now, so it's safe to check again.
+		if err != nil {
+			avail = ring.pseq.get()
+
+			if avail <= next {
+				return nil
+			}
+		}
+
+		for seq := next; seq < avail; seq++ {
+			this.handler(ring.Get(seq), seq, seq == avail-1)
+		}
+
+		// Only now can the producers reuse the entries.
+		this.seq.set(avail)
+		ring.waiter.Signal()
+
+		next = avail
+	}
+}
+
+// Sequence returns the sequence of the next entry the processor will handle, which is
+// also the number of entries it has handled so far.
+func (this *EventProcessor[E]) Sequence() int64 {
+	return this.seq.get()
+}
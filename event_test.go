@@ -0,0 +1,177 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+type event struct {
+	producer int
+	value    int
+}
+
+func TestEventRing(t *testing.T) {
+	allocs := 0
+
+	ring, err := NewEventRing(64, func() *event {
+		allocs++
+		return &event{}
+	}, nil)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 64, allocs)
+
+	producers, n := 4, 2000
+
+	// Both handlers see every event, with each producer's events in order
+	var (
+		sums    [2][]int
+		batches [2]int
+		procs   [2]*EventProcessor[*event]
+	)
+
+	for i := range procs {
+		i := i
+		sums[i] = make([]int, producers)
+		last := make([]int, producers)
+
+		procs[i], err = ring.AddHandler(func(e **event, seq int64, endOfBatch bool) {
+			assert.Equal(t, true, last[(*e).producer], (*e).value)
+
+			last[(*e).producer]++
+			sums[i][(*e).producer]++
+
+			if endOfBatch {
+				batches[i]++
+			}
+		})
+
+		assert.NoError(t, true, err)
+	}
+
+	var pwg, cwg sync.WaitGroup
+
+	for _, p := range procs {
+		cwg.Add(1)
+
+		go func(p *EventProcessor[*event]) {
+			defer cwg.Done()
+
+			assert.NoError(t, true, p.Run())
+		}(p)
+	}
+
+	for i := 0; i < producers; i++ {
+		pwg.Add(1)
+
+		go func(id int) {
+			defer pwg.Done()
+
+			for j := 0; j < n; j++ {
+				seq, err := ring.Next()
+
+				assert.NoError(t, true, err)
+
+				// Fill in the entry in place, no allocation
+				e := *ring.Get(seq)
+				e.producer = id
+				e.value = j
+
+				ring.Publish(seq)
+			}
+		}(i)
+	}
+
+	pwg.Wait()
+	ring.Close()
+	cwg.Wait()
+
+	assert.Equal(t, true, 64, allocs)
+
+	for i := range procs {
+		assert.Equal(t, true, int64(producers*n), procs[i].Sequence())
+		assert.True(t, true, batches[i] > 0)
+
+		for _, sum := range sums[i] {
+			assert.Equal(t, true, n, sum)
+		}
+	}
+
+	_, err = ring.Next()
+
+	assert.Error(t, true, err)
+
+	_, err = ring.AddHandler(func(e **event, seq int64, endOfBatch bool) {})
+
+	assert.Error(t, true, err)
+}
+
+func TestEventRingPublishOutOfOrder(t *testing.T) {
+	ring, err := NewEventRing(4, func() int { return 0 }, nil)
+
+	assert.NoError(t, true, err)
+
+	var seen []int
+
+	p, err := ring.AddHandler(func(e *int, seq int64, endOfBatch bool) {
+		seen = append(seen, *e)
+	})
+
+	assert.NoError(t, true, err)
+
+	done := make(chan error)
+
+	go func() {
+		done <- p.Run()
+	}()
+
+	// Publish each pair of entries backwards, wrapping around the ring a few times.
+	// The second one only becomes visible along with the first.
+	n := 16
+
+	for i := 0; i < n; i += 2 {
+		first, err := ring.Next()
+
+		assert.NoError(t, true, err)
+
+		second, err := ring.Next()
+
+		assert.NoError(t, true, err)
+
+		*ring.Get(first) = i
+		*ring.Get(second) = i + 1
+
+		ring.Publish(second)
+
+		assert.Equal(t, true, first, ring.pseq.get())
+
+		ring.Publish(first)
+
+		assert.Equal(t, true, second+1, ring.pseq.get())
+	}
+
+	ring.Close()
+
+	assert.NoError(t, true, <-done)
+	assert.Equal(t, true, n, len(seen))
+
+	for i := range seen {
+		assert.Equal(t, true, i, seen[i])
+	}
+}
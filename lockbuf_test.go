@@ -26,6 +26,14 @@ func TestLockBufferReadFrom(t *testing.T) {
 	fillLockBuffer(t, 3072, 4096)
 }
 
+func TestLockBufferReadFromSpan(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadFromSpan(t, buf, 4096)
+}
+
 func TestLockBufferReadBytes(t *testing.T) {
 	buf := fillLockBuffer(t, 2048, 4096)
 
@@ -54,6 +62,30 @@ func TestLockBufferConsumerProducerWriteTo(t *testing.T) {
 	testWriteTo(t, buf)
 }
 
+func TestLockBufferConsumerProducerCloseWrite(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWrite(t, buf)
+}
+
+func TestLockBufferCloseWithError(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWithError(t, buf)
+}
+
+func TestLockBufferConsumerProducerLargeWrite(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testLargeWrite(t, buf)
+}
+
 func TestLockBufferConsumerProducerPeekCommit(t *testing.T) {
 	buf, err := NewLockBuffer(4096)
 
@@ -62,6 +94,54 @@ func TestLockBufferConsumerProducerPeekCommit(t *testing.T) {
 	testPeekCommit(t, buf)
 }
 
+func TestLockBufferReservePublish(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReservePublish(t, buf)
+}
+
+func TestLockBufferReserveWrite(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReserveWrite(t, buf)
+}
+
+func TestLockBufferConsumerProducerDiscard(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testDiscard(t, buf)
+}
+
+func TestLockBufferReadAt(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAt(t, buf)
+}
+
+func TestLockBufferReadAtConcurrent(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAtConcurrent(t, buf)
+}
+
+func TestLockBufferMarkRewind(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testMarkRewind(t, buf)
+}
+
 func TestLockBufferPeek(t *testing.T) {
 	buf := fillLockBuffer(t, 2048, 4096)
 
@@ -69,6 +149,116 @@ func TestLockBufferPeek(t *testing.T) {
 	peekBuffer(t, buf, 1000)
 }
 
+func TestLockBufferContext(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testContext(t, buf)
+}
+
+func TestLockBufferDeadline(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testDeadline(t, buf)
+}
+
+func TestLockBufferTry(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testTry(t, buf)
+}
+
+func TestLockBufferPeekVec(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testPeekVec(t, buf)
+}
+
+func TestLockBufferBufio(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testBufio(t, buf)
+}
+
+func TestLockBufferReset(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReset(t, buf)
+}
+
+func TestLockBufferReadiness(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadiness(t, buf)
+}
+
+func TestLockBufferResetReadiness(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testResetReadiness(t, buf)
+}
+
+func TestLockBufferWatermarks(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarks(t, buf)
+}
+
+func TestLockBufferWatermarksUnread(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarksUnread(t, buf)
+}
+
+func TestLockBufferWatermarksConcurrent(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarksConcurrent(t, buf)
+}
+
+func TestLockBufferWatermarkPanic(t *testing.T) {
+	buf, err := NewLockBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	buf.OnHighWater(100, func() { panic("high water") })
+
+	func() {
+		defer func() {
+			assert.Equal(t, true, "high water", recover())
+		}()
+
+		buf.Write(make([]byte, 100))
+	}()
+
+	// The hook's lock must not be left held, or this would hang.
+	n, err := buf.Read(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+}
+
 func BenchmarkLockBufferConsumerProducerRead(b *testing.B) {
 	buf, _ := NewLockBuffer(0)
 	benchmarkRead(b, buf)
@@ -26,6 +26,14 @@ func TestLockFreeBufferReadFrom(t *testing.T) {
 	fillLockFreeBuffer(t, 3072, 4096)
 }
 
+func TestLockFreeBufferReadFromSpan(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadFromSpan(t, buf, 4096)
+}
+
 func TestLockFreeBufferReadBytes(t *testing.T) {
 	buf := fillLockFreeBuffer(t, 2048, 4096)
 
@@ -54,6 +62,30 @@ func TestLockFreeBufferConsumerProducerWriteTo(t *testing.T) {
 	testWriteTo(t, buf)
 }
 
+func TestLockFreeBufferConsumerProducerCloseWrite(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWrite(t, buf)
+}
+
+func TestLockFreeBufferCloseWithError(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWithError(t, buf)
+}
+
+func TestLockFreeBufferConsumerProducerLargeWrite(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testLargeWrite(t, buf)
+}
+
 func TestLockFreeBufferConsumerProducerPeekCommit(t *testing.T) {
 	buf, err := NewLockFreeBuffer(4096)
 
@@ -62,6 +94,54 @@ func TestLockFreeBufferConsumerProducerPeekCommit(t *testing.T) {
 	testPeekCommit(t, buf)
 }
 
+func TestLockFreeBufferReservePublish(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReservePublish(t, buf)
+}
+
+func TestLockFreeBufferReserveWrite(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReserveWrite(t, buf)
+}
+
+func TestLockFreeBufferConsumerProducerDiscard(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testDiscard(t, buf)
+}
+
+func TestLockFreeBufferReadAt(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAt(t, buf)
+}
+
+func TestLockFreeBufferReadAtConcurrent(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAtConcurrent(t, buf)
+}
+
+func TestLockFreeBufferMarkRewind(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testMarkRewind(t, buf)
+}
+
 func TestLockFreeBufferPeek(t *testing.T) {
 	lfbuf := fillLockFreeBuffer(t, 2048, 4096)
 
@@ -69,6 +149,94 @@ func TestLockFreeBufferPeek(t *testing.T) {
 	peekBuffer(t, lfbuf, 1000)
 }
 
+func TestLockFreeBufferContext(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testContext(t, buf)
+}
+
+func TestLockFreeBufferDeadline(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testDeadline(t, buf)
+}
+
+func TestLockFreeBufferTry(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testTry(t, buf)
+}
+
+func TestLockFreeBufferPeekVec(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testPeekVec(t, buf)
+}
+
+func TestLockFreeBufferBufio(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testBufio(t, buf)
+}
+
+func TestLockFreeBufferReset(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReset(t, buf)
+}
+
+func TestLockFreeBufferReadiness(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadiness(t, buf)
+}
+
+func TestLockFreeBufferResetReadiness(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testResetReadiness(t, buf)
+}
+
+func TestLockFreeBufferWatermarks(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarks(t, buf)
+}
+
+func TestLockFreeBufferWatermarksUnread(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarksUnread(t, buf)
+}
+
+func TestLockFreeBufferWatermarksConcurrent(t *testing.T) {
+	buf, err := NewLockFreeBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarksConcurrent(t, buf)
+}
+
 func BenchmarkLockFreeBufferConsumerProducerRead(b *testing.B) {
 	buf, _ := NewLockFreeBuffer(0)
 	benchmarkRead(b, buf)
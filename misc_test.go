@@ -15,8 +15,12 @@
 package ringbuffer2
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"net"
 	"testing"
 	"time"
 
@@ -60,6 +64,47 @@ func fillBuffer(t *testing.T, buf RingBuffer, bufsize int64) {
 	assert.Equal(t, true, err, io.EOF)
 }
 
+// sizeReader records how many bytes each call to Read asked for
+type sizeReader struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (this *sizeReader) Read(p []byte) (int, error) {
+	this.sizes = append(this.sizes, len(p))
+	return this.r.Read(p)
+}
+
+func testReadFromSpan(t *testing.T, buf RingBuffer, max int) {
+	// Move the cursors so the free space wraps around the end of the buffer
+	n, err := buf.Write(make([]byte, 1000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1000, n)
+
+	n, err = buf.Commit(1000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1000, n)
+
+	r := &sizeReader{r: bytes.NewBuffer(make([]byte, 3072))}
+
+	m, err := buf.ReadFrom(r)
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 3072, m)
+
+	for _, size := range r.sizes {
+		assert.True(t, true, size <= max)
+	}
+
+	if max >= 4096 {
+		// One read for all the space up to the end of the buffer, then one that gets
+		// io.EOF for what's left of it
+		assert.Equal(t, true, []int{3096, 24}, r.sizes)
+	}
+}
+
 func peekBuffer(t *testing.T, buf RingBuffer, n int) {
 	pkbuf, err := buf.Peek(n)
 
@@ -109,6 +154,341 @@ func testWriteTo(t *testing.T, buf RingBuffer) {
 	assert.Equal(t, true, 10000, m)
 }
 
+func testCloseWrite(t *testing.T, buf RingBuffer) {
+	n := int64(10000)
+
+	go func(n int64) {
+		fillBuffer(t, buf, n)
+		buf.CloseWrite()
+	}(n)
+
+	m, err := buf.WriteTo(bytes.NewBuffer(make([]byte, n)))
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 10000, m)
+
+	_, err = buf.Read(make([]byte, 10))
+
+	assert.Equal(t, true, io.EOF, err)
+
+	_, err = buf.Write(make([]byte, 10))
+
+	assert.Equal(t, true, io.ErrClosedPipe, err)
+}
+
+func testCloseWithError(t *testing.T, buf RingBuffer) {
+	reset := errors.New("connection reset")
+
+	n, err := buf.Write(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	buf.CloseWithError(reset)
+
+	// Only the first close counts
+	buf.CloseWrite()
+
+	// Buffered data should still be there
+	_, err = buf.Commit(200)
+
+	assert.Equal(t, true, ErrBufferInsufficientData, err)
+
+	n, err = buf.Read(make([]byte, 50))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 50, n)
+
+	m, err := buf.WriteTo(bytes.NewBuffer(nil))
+
+	assert.Equal(t, true, reset, err)
+	assert.Equal(t, true, 50, m)
+
+	_, err = buf.Read(make([]byte, 10))
+
+	assert.Equal(t, true, reset, err)
+
+	_, err = buf.Peek(10)
+
+	assert.Equal(t, true, reset, err)
+
+	_, err = buf.Commit(10)
+
+	assert.Equal(t, true, reset, err)
+
+	_, err = buf.Write(make([]byte, 10))
+
+	assert.Equal(t, true, io.ErrClosedPipe, err)
+}
+
+func testReservePublish(t *testing.T, buf RingBuffer) {
+	// Move the cursors close to the end of the buffer so the reservation wraps
+	n, err := buf.Write(make([]byte, 4000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	n, err = buf.Commit(4000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	vec, err := buf.Reserve(200)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 2, len(vec))
+	assert.Equal(t, true, 96, len(vec[0]))
+	assert.Equal(t, true, 104, len(vec[1]))
+
+	i := 0
+	for _, p := range vec {
+		for j := range p {
+			p[j] = byte(i)
+			i++
+		}
+	}
+
+	// Nothing is visible until it's published
+	assert.Equal(t, true, 0, buf.Len())
+
+	n, err = buf.Publish(150)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 150, n)
+	assert.Equal(t, true, 150, buf.Len())
+
+	n, err = buf.Publish(50)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 50, n)
+	assert.Equal(t, true, 200, buf.Len())
+
+	_, err = buf.Publish(1)
+
+	assert.Equal(t, true, ErrBufferInsufficientReserve, err)
+
+	p := make([]byte, 200)
+	for i = 0; i < len(p); {
+		n, err = buf.Read(p[i:])
+
+		assert.NoError(t, true, err)
+
+		i += n
+	}
+
+	for i, b := range p {
+		assert.Equal(t, true, byte(i), b)
+	}
+
+	_, err = buf.Reserve(4097)
+
+	assert.Equal(t, true, bufio.ErrBufferFull, err)
+}
+
+func testReserveWrite(t *testing.T, buf RingBuffer) {
+	_, err := buf.Reserve(100)
+
+	assert.NoError(t, true, err)
+
+	// Writing drops the reservation, so there's nothing left to publish
+	n, err := buf.Write(make([]byte, 4000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	n, err = buf.Publish(100)
+
+	assert.Equal(t, true, ErrBufferInsufficientReserve, err)
+	assert.Equal(t, true, 0, n)
+	assert.Equal(t, true, 4000, buf.Len())
+	assert.Equal(t, true, 96, buf.Free())
+}
+
+func testPeekVec(t *testing.T, buf RingBuffer) {
+	// Move the cursors close to the end of the buffer so the data wraps
+	n, err := buf.Write(make([]byte, 4000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	n, err = buf.Commit(4000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	p := make([]byte, 200)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	n, err = buf.Write(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 200, n)
+
+	vec, err := buf.PeekVec(150)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 2, len(vec))
+	assert.Equal(t, true, 96, len(vec[0]))
+	assert.Equal(t, true, 54, len(vec[1]))
+
+	// Peeking again shouldn't affect what we got before
+	pkbuf, err := buf.Peek(120)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, p[:120], pkbuf)
+
+	vec2, err := buf.PeekVec(300)
+
+	assert.Equal(t, true, ErrBufferInsufficientData, err)
+	assert.Equal(t, true, 2, len(vec2))
+	assert.Equal(t, true, 104, len(vec2[1]))
+
+	assert.Equal(t, true, p[:96], vec[0])
+	assert.Equal(t, true, p[96:150], vec[1])
+
+	var out bytes.Buffer
+
+	m, err := vec2.WriteTo(&out)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 200, m)
+	assert.Equal(t, true, p, out.Bytes())
+}
+
+func testBufio(t *testing.T, buf RingBuffer) {
+	// No delimiter in a full buffer
+	n, err := buf.Write(bytes.Repeat([]byte{'a'}, 4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, n)
+
+	line, err := buf.ReadSlice('\n')
+
+	assert.Equal(t, true, bufio.ErrBufferFull, err)
+	assert.Equal(t, true, 4096, len(line))
+
+	// The slice stays valid, and can't be overwritten, until the next read
+	n, err = buf.TryWrite([]byte{'b'})
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 0, n)
+
+	n, err = buf.Commit(0)
+
+	assert.NoError(t, true, err)
+
+	// Move the cursors close to the end of the buffer so the data wraps
+	n, err = buf.Write(make([]byte, 4090))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4090, n)
+
+	n, err = buf.Commit(4090)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4090, n)
+
+	n, err = buf.Write([]byte("abcd\u20acx\nline two\r\nrest"))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 23, n)
+
+	c, err := buf.ReadByte()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 'a', c)
+	assert.NoError(t, true, buf.UnreadByte())
+	assert.Equal(t, true, bufio.ErrInvalidUnreadByte, buf.UnreadByte())
+
+	c, err = buf.ReadByte()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 'a', c)
+	assert.Equal(t, true, bufio.ErrInvalidUnreadRune, buf.UnreadRune())
+
+	for _, exp := range "bcd" {
+		r, size, err := buf.ReadRune()
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, exp, r)
+		assert.Equal(t, true, 1, size)
+	}
+
+	// This one wraps around the end of the buffer
+	r, size, err := buf.ReadRune()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, '\u20ac', r)
+	assert.Equal(t, true, 3, size)
+	assert.NoError(t, true, buf.UnreadRune())
+
+	r, size, err = buf.ReadRune()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, '\u20ac', r)
+	assert.Equal(t, true, 3, size)
+
+	str, err := buf.ReadString('\n')
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "x\n", str)
+
+	line, isPrefix, err := buf.ReadLine()
+
+	assert.NoError(t, true, err)
+	assert.False(t, true, isPrefix)
+	assert.Equal(t, true, "line two", string(line))
+
+	buf.CloseWrite()
+
+	line, isPrefix, err = buf.ReadLine()
+
+	assert.NoError(t, true, err)
+	assert.False(t, true, isPrefix)
+	assert.Equal(t, true, "rest", string(line))
+
+	line, isPrefix, err = buf.ReadLine()
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 0, len(line))
+
+	_, err = buf.ReadByte()
+
+	assert.Equal(t, true, io.EOF, err)
+}
+
+func testLargeWrite(t *testing.T, buf RingBuffer) {
+	n := 10000
+
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	go func() {
+		m, err := buf.Write(p)
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, n, m)
+
+		buf.WriteString("hello")
+		buf.WriteByte(' ')
+		buf.WriteRune('\u4e16')
+		buf.CloseWrite()
+	}()
+
+	var out bytes.Buffer
+
+	m, err := buf.WriteTo(&out)
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, n+9, m)
+	assert.Equal(t, true, p, out.Bytes()[:n])
+	assert.Equal(t, true, "hello \u4e16", out.String()[n:])
+}
+
 func testRead(t *testing.T, buf RingBuffer) {
 	n := int64(10000)
 
@@ -141,6 +521,417 @@ func testCommit(t *testing.T, buf RingBuffer) {
 	assert.Equal(t, true, ErrBufferInsufficientData, err)
 }
 
+func testReadAt(t *testing.T, buf RingBuffer) {
+	p := make([]byte, 3000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	n, err := buf.Write(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 3000, n)
+
+	n, err = buf.Discard(3000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 3000, n)
+	assert.Equal(t, true, int64(3000), buf.Consumed())
+
+	// Look back at data that has been consumed
+	q := make([]byte, 100)
+
+	n, err = buf.ReadAt(q, 500)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+	assert.Equal(t, true, p[500:600], q)
+
+	n, err = buf.ReadAt(q, 2950)
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 50, n)
+	assert.Equal(t, true, p[2950:], q[:50])
+
+	// This wraps around the end of the buffer and overwrites the first 1904 bytes
+	n, err = buf.Write(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 3000, n)
+	assert.Equal(t, true, int64(6000), buf.Produced())
+
+	n, err = buf.ReadAt(q, 1800)
+
+	assert.Equal(t, true, ErrBufferOverwritten, err)
+	assert.Equal(t, true, 0, n)
+
+	n, err = buf.ReadAt(q, 2000)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+	assert.Equal(t, true, p[2000:2100], q)
+
+	// Across the end of the buffer
+	n, err = buf.ReadAt(q, 4050)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+	assert.Equal(t, true, p[1050:1150], q)
+}
+
+func testReadAtConcurrent(t *testing.T, buf RingBuffer) {
+	// Every byte is the low byte of its position in the stream
+	go func() {
+		p := make([]byte, 100)
+
+		for pos := 0; pos < 100000; pos += len(p) {
+			for i := range p {
+				p[i] = byte(pos + i)
+			}
+
+			_, err := buf.Write(p)
+
+			assert.NoError(t, false, err)
+		}
+
+		buf.CloseWrite()
+	}()
+
+	p := make([]byte, 100)
+	q := make([]byte, 100)
+
+	for {
+		if _, err := buf.Read(p); err == io.EOF {
+			break
+		}
+
+		// Look back at bytes the producer is about to overwrite
+		off := buf.Consumed() - 3500
+		if off < 0 {
+			continue
+		}
+
+		n, err := buf.ReadAt(q, off)
+		if err == ErrBufferOverwritten {
+			continue
+		}
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, len(q), n)
+
+		for i := range q {
+			assert.Equal(t, true, byte(off+int64(i)), q[i])
+		}
+	}
+}
+
+func testMarkRewind(t *testing.T, buf RingBuffer) {
+	n, err := buf.WriteString("abcdef")
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 6, n)
+
+	p := make([]byte, 3)
+
+	mark := buf.Mark()
+
+	n, err = buf.Read(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "abc", string(p[:n]))
+
+	// Nested mark
+	mark2 := buf.Mark()
+
+	n, err = buf.Read(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "def", string(p[:n]))
+	assert.NoError(t, true, buf.Rewind(mark))
+
+	// Rewinding to the outer mark released the inner one too
+	assert.Equal(t, true, ErrBufferInvalidMark, buf.Rewind(mark2))
+	assert.Equal(t, true, ErrBufferInvalidMark, buf.Unmark(mark))
+	assert.Equal(t, true, 6, buf.Len())
+
+	str, err := buf.ReadString('f')
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "abcdef", str)
+
+	// The producer can't overwrite marked data, even after it has been read
+	mark = buf.Mark()
+
+	n, err = buf.Write(make([]byte, 4090))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4090, n)
+
+	n, err = buf.Discard(4090)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 0, buf.Len())
+	assert.Equal(t, true, 6, buf.Free())
+
+	n, err = buf.TryWrite(make([]byte, 10))
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 6, n)
+	assert.NoError(t, true, buf.Unmark(mark))
+	assert.Equal(t, true, 4090, buf.Free())
+}
+
+func testDiscard(t *testing.T, buf RingBuffer) {
+	n := 10000
+
+	go func() {
+		fillBuffer(t, buf, int64(n))
+		buf.WriteString("end")
+		buf.CloseWrite()
+	}()
+
+	m, err := buf.Discard(n)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, n, m)
+
+	m, err = buf.Discard(10)
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 3, m)
+}
+
+func testReset(t *testing.T, buf RingBuffer) {
+	n, err := buf.Write(make([]byte, 1000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1000, n)
+
+	n, err = buf.Commit(300)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, buf.Cap())
+	assert.Equal(t, true, 700, buf.Len())
+	assert.Equal(t, true, 4096-700, buf.Free())
+	assert.Equal(t, true, 1000, buf.Produced())
+	assert.Equal(t, true, 300, buf.Consumed())
+
+	buf.CloseWithError(errors.New("connection reset"))
+	buf.Reset()
+
+	assert.Equal(t, true, 0, buf.Len())
+	assert.Equal(t, true, 4096, buf.Free())
+	assert.Equal(t, true, 0, buf.Produced())
+	assert.Equal(t, true, 0, buf.Consumed())
+
+	// It should work like a new buffer
+	fillBuffer(t, buf, 2048)
+	testReadBytes(t, buf)
+}
+
+// fired reports whether ch has fired, or fires within d
+func fired(ch <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+
+	select {
+	case <-ch:
+		return true
+
+	case <-time.After(d):
+		return false
+	}
+}
+
+func testReadiness(t *testing.T, buf RingBuffer) {
+	readable := buf.Readable()
+
+	assert.False(t, true, fired(readable, 10*time.Millisecond))
+
+	// There's space in an empty buffer
+	assert.True(t, true, fired(buf.Writable(), 0))
+
+	n, err := buf.Write(make([]byte, 4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, n)
+	assert.True(t, true, fired(readable, 0))
+	assert.True(t, true, fired(buf.Readable(), 0))
+
+	writable := buf.Writable()
+
+	assert.False(t, true, fired(writable, 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		buf.Discard(100)
+	}()
+
+	assert.True(t, true, fired(writable, time.Second))
+
+	done := buf.Done()
+
+	assert.False(t, true, fired(done, 10*time.Millisecond))
+
+	buf.CloseWrite()
+
+	assert.True(t, true, fired(done, 0))
+	assert.Equal(t, true, done, buf.Done())
+}
+
+func testWatermarks(t *testing.T, buf RingBuffer) {
+	var high, low int
+
+	buf.OnHighWater(3000, func() { high++ })
+	buf.OnLowWater(1000, func() { low++ })
+
+	write := func(n int) {
+		m, err := buf.Write(make([]byte, n))
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, n, m)
+	}
+
+	discard := func(n int) {
+		m, err := buf.Discard(n)
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, n, m)
+	}
+
+	write(2000)
+
+	assert.Equal(t, true, 0, high)
+	assert.Equal(t, true, 0, low)
+
+	write(1500)
+
+	assert.Equal(t, true, 1, high)
+
+	// Staying above the threshold, or falling back but not to the low watermark,
+	// doesn't count
+	write(100)
+	discard(1000)
+
+	assert.Equal(t, true, 1, high)
+	assert.Equal(t, true, 0, low)
+
+	discard(1700)
+
+	assert.Equal(t, true, 1, high)
+	assert.Equal(t, true, 1, low)
+
+	write(3000)
+
+	assert.Equal(t, true, 2, high)
+	assert.Equal(t, true, 1, low)
+}
+
+func testResetReadiness(t *testing.T, buf RingBuffer) {
+	readable := buf.Readable()
+	done := buf.Done()
+
+	assert.False(t, true, fired(readable, 10*time.Millisecond))
+	assert.False(t, true, fired(done, 0))
+
+	// Whoever waits on the old channels must not be left hanging
+	buf.Reset()
+
+	assert.True(t, true, fired(readable, 0))
+	assert.True(t, true, fired(done, 0))
+
+	// The buffer isn't closed, so a new Done channel doesn't fire until it is
+	done = buf.Done()
+
+	assert.False(t, true, fired(done, 10*time.Millisecond))
+
+	buf.Close()
+
+	assert.True(t, true, fired(done, 0))
+}
+
+func testWatermarksUnread(t *testing.T, buf RingBuffer) {
+	var high int
+
+	buf.OnHighWater(100, func() { high++ })
+
+	_, err := buf.Write(bytes.Repeat([]byte{'a'}, 100))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1, high)
+
+	// Going back over what was read makes Len() rise again
+	mark := buf.Mark()
+
+	_, err = buf.Read(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+	assert.NoError(t, true, buf.Rewind(mark))
+	assert.Equal(t, true, 100, buf.Len())
+	assert.Equal(t, true, 2, high)
+
+	_, err = buf.ReadByte()
+
+	assert.NoError(t, true, err)
+	assert.NoError(t, true, buf.UnreadByte())
+	assert.Equal(t, true, 3, high)
+
+	_, _, err = buf.ReadRune()
+
+	assert.NoError(t, true, err)
+	assert.NoError(t, true, buf.UnreadRune())
+	assert.Equal(t, true, 4, high)
+}
+
+func testWatermarksConcurrent(t *testing.T, buf RingBuffer) {
+	var high, low int
+
+	// A high watermark at 1001 and a low one at 1000 see exactly the same crossings, so
+	// they must take turns, starting with the high one since Len() starts out below
+	// both. The hooks run on either goroutine, so they must not stop the test.
+	buf.OnHighWater(1001, func() {
+		assert.Equal(t, false, low, high)
+		high++
+	})
+
+	buf.OnLowWater(1000, func() {
+		assert.Equal(t, false, high, low+1)
+		low++
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		p := make([]byte, 100)
+
+		for {
+			if _, err := buf.Read(p); err == io.EOF {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		_, err := buf.Write(make([]byte, 100))
+
+		assert.NoError(t, true, err)
+	}
+
+	buf.CloseWrite()
+
+	<-done
+
+	// The buffer ends up empty, so every high water mark must have been followed by a
+	// low one.
+	assert.Equal(t, true, 0, buf.Len())
+	assert.Equal(t, true, high, low)
+}
+
 func testReadBytes(t *testing.T, buf RingBuffer) {
 	p := make([]byte, 256)
 	n, err := buf.Read(p)
@@ -155,6 +946,167 @@ func testReadBytes(t *testing.T, buf RingBuffer) {
 	assert.Equal(t, true, 2048-256, n)
 }
 
+func testContext(t *testing.T, buf RingBuffer) {
+	p := make([]byte, 100)
+
+	// Nothing to read or peek, so these should wait until the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	n, err := buf.ReadContext(ctx, p)
+
+	assert.Equal(t, true, context.DeadlineExceeded, err)
+	assert.Equal(t, true, 0, n)
+
+	_, err = buf.PeekContext(ctx, 10)
+
+	assert.Equal(t, true, context.DeadlineExceeded, err)
+
+	// Fill up the buffer, then cancel a write that's waiting for space
+	n, err = buf.Write(make([]byte, 4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, n)
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+
+	n, err = buf.WriteContext(ctx, p)
+
+	assert.Equal(t, true, context.Canceled, err)
+	assert.Equal(t, true, 0, n)
+
+	m, err := buf.ReadFromContext(ctx, bytes.NewBuffer(p))
+
+	assert.Equal(t, true, context.Canceled, err)
+	assert.Equal(t, true, 0, m)
+
+	// The buffer should still be usable afterwards
+	n, err = buf.Read(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	n, err = buf.Write(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+}
+
+func testDeadline(t *testing.T, buf RingBuffer) {
+	p := make([]byte, 100)
+
+	// Nothing to read, so this should time out
+	buf.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+
+	n, err := buf.Read(p)
+
+	assert.Equal(t, true, ErrBufferTimeout, err)
+	assert.Equal(t, true, 0, n)
+
+	ne, ok := err.(net.Error)
+
+	assert.True(t, true, ok)
+	assert.True(t, true, ne.Timeout())
+
+	// Moving the deadline should affect reads that are already waiting
+	buf.SetReadDeadline(time.Time{})
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		buf.SetReadDeadline(time.Now())
+	}()
+
+	_, err = buf.Peek(10)
+
+	assert.Equal(t, true, ErrBufferTimeout, err)
+
+	// Clearing the deadline lets reads wait again
+	buf.SetReadDeadline(time.Time{})
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		buf.Write(p)
+	}()
+
+	n, err = buf.Read(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	// Fill up the buffer so the next write has to wait for space
+	n, err = buf.Write(make([]byte, 4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, n)
+
+	buf.SetDeadline(time.Now().Add(time.Millisecond * 10))
+
+	n, err = buf.Write(p)
+
+	assert.Equal(t, true, ErrBufferTimeout, err)
+	assert.Equal(t, true, 0, n)
+}
+
+func testTry(t *testing.T, buf RingBuffer) {
+	p := make([]byte, 100)
+
+	n, err := buf.TryRead(p)
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 0, n)
+
+	_, err = buf.TryPeek(10)
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+
+	n, err = buf.TryWrite(make([]byte, 4000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+
+	// Only 96 bytes of space left
+	n, err = buf.TryWrite(p)
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 96, n)
+
+	n, err = buf.TryWrite(p)
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 0, n)
+
+	pkbuf, err := buf.TryPeek(10)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 10, len(pkbuf))
+
+	n, err = buf.TryRead(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	n, err = buf.TryWrite(p)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	// Once closed, an empty buffer should report io.EOF instead
+	buf.Close()
+
+	for {
+		if _, err = buf.TryRead(p); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t, true, io.EOF, err)
+}
+
 func benchmarkRead(b *testing.B, buf RingBuffer) {
 	n := int64(b.N)
 
@@ -0,0 +1,329 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// MultiConsumerBuffer is a MultiProducerBuffer that any number of goroutines can also
+// read from at the same time, e.g., to fan work out to a pool of workers. Each read
+// claims a range of data for the calling consumer by moving the consumer claim with a
+// CAS, so no two consumers ever see the same bytes. The producers can reuse the space
+// once every consumer that claimed data before it is done with its own.
+//
+// Since the consumers only ever see the bytes they claim, operations that look ahead or
+// go back, such as Peek, ReadSlice, UnreadByte and Mark, are not supported. Writes are
+// atomic, so if every message has the same size, each Read of that size gets exactly
+// one message.
+type MultiConsumerBuffer struct {
+	*MultiProducerBuffer
+}
+
+var _ RingBuffer = (*MultiConsumerBuffer)(nil)
+
+func NewMultiConsumerBuffer(size int64) (*MultiConsumerBuffer, error) {
+	o, err := newOptions(WithSize(size), WithKind(MultiConsumerKind))
+	if err != nil {
+		return nil, err
+	}
+
+	return newMultiConsumerBuffer(o), nil
+}
+
+func newMultiConsumerBuffer(o *options) *MultiConsumerBuffer {
+	this := &MultiConsumerBuffer{
+		MultiProducerBuffer: newMultiProducerBuffer(o),
+	}
+
+	this.lenFn = this.Len
+
+	return this
+}
+
+// Len returns the number of bytes that haven't been claimed by any consumer yet.
+func (this *MultiConsumerBuffer) Len() int {
+	return int(this.pseq.get() - this.cseq.getClaim())
+}
+
+// WriteTo writes data to w until the buffer is closed or w returns an error. Each write
+// to w is a range of up to the write block size claimed from the buffer, so it's safe to
+// run WriteTo alongside other consumers.
+func (this *MultiConsumerBuffer) WriteTo(w io.Writer) (int64, error) {
+	total := int64(0)
+	p := make([]byte, this.wbsize)
+
+	for {
+		start, m, err := this.take(context.Background(), int64(this.wbsize), true)
+		if err != nil {
+			return total, err
+		}
+
+		// Copy the data out and release it before writing, since w may block for a
+		// long time and the consumers that claimed after us can't release until we do.
+		ringRead(p[:m], this.buf, start&this.mask)
+
+		this.release(start, m)
+
+		n, err := w.Write(p[:m])
+
+		total += int64(n)
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (this *MultiConsumerBuffer) Read(p []byte) (int, error) {
+	return this.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but gives up waiting for data once ctx is done, in which
+// case ctx.Err() is returned.
+func (this *MultiConsumerBuffer) ReadContext(ctx context.Context, p []byte) (int, error) {
+	start, m, err := this.take(ctx, int64(len(p)), true)
+	if err != nil {
+		return 0, err
+	}
+
+	ringRead(p[:m], this.buf, start&this.mask)
+
+	this.release(start, m)
+
+	return int(m), nil
+}
+
+// TryRead is the non-blocking version of Read. If there's no data to read, it returns
+// ErrBufferWouldBlock right away instead of waiting for the producer.
+func (this *MultiConsumerBuffer) TryRead(p []byte) (int, error) {
+	start, m, err := this.take(context.Background(), int64(len(p)), false)
+	if err != nil {
+		return 0, err
+	}
+
+	ringRead(p[:m], this.buf, start&this.mask)
+
+	this.release(start, m)
+
+	return int(m), nil
+}
+
+// ReadByte reads and returns a single byte, waiting for the producer if there is none.
+func (this *MultiConsumerBuffer) ReadByte() (byte, error) {
+	start, _, err := this.take(context.Background(), 1, true)
+	if err != nil {
+		return 0, err
+	}
+
+	c := this.buf[start&this.mask]
+
+	this.release(start, 1)
+
+	return c, nil
+}
+
+// Commit claims the next n bytes and skips them. Unlike Read, it only claims data if
+// all n bytes are there, otherwise the error is ErrBufferInsufficientData.
+func (this *MultiConsumerBuffer) Commit(n int) (int, error) {
+	if int64(n) > this.size {
+		return 0, bufio.ErrBufferFull
+	}
+
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	for {
+		// Check for close first so we don't miss any data written right before it
+		werr := this.werr.get()
+
+		cpos := this.cseq.getClaim()
+		ppos := this.pseq.get()
+
+		if cpos+int64(n) > ppos {
+			// There's nothing left, and there never will be
+			if werr != nil && cpos >= ppos {
+				return 0, werr
+			}
+
+			return 0, ErrBufferInsufficientData
+		}
+
+		if this.cseq.casClaim(cpos, cpos+int64(n)) {
+			this.release(cpos, int64(n))
+			return n, nil
+		}
+	}
+}
+
+// Discard skips the next n bytes, waiting for the producer as needed, and returns the
+// number of bytes discarded. The bytes are claimed a range at a time, so other
+// consumers may get some of the data in between.
+func (this *MultiConsumerBuffer) Discard(n int) (int, error) {
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	total := int64(0)
+
+	for total < int64(n) {
+		start, m, err := this.take(context.Background(), int64(n)-total, true)
+		if err != nil {
+			return int(total), err
+		}
+
+		this.release(start, m)
+
+		total += m
+	}
+
+	return n, nil
+}
+
+// Peek is not supported, since the data could be claimed by another consumer right
+// after. It always returns ErrBufferUnsupported.
+func (this *MultiConsumerBuffer) Peek(n int) ([]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+// PeekContext is not supported, see Peek.
+func (this *MultiConsumerBuffer) PeekContext(ctx context.Context, n int) ([]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+// TryPeek is not supported, see Peek.
+func (this *MultiConsumerBuffer) TryPeek(n int) ([]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+// PeekVec is not supported, see Peek.
+func (this *MultiConsumerBuffer) PeekVec(n int) (net.Buffers, error) {
+	return nil, ErrBufferUnsupported
+}
+
+// UnreadByte is not supported, since the byte may already be reused by the producers.
+// It always returns ErrBufferUnsupported.
+func (this *MultiConsumerBuffer) UnreadByte() error {
+	return ErrBufferUnsupported
+}
+
+// ReadRune is not supported, since a rune could be split between two consumers. It
+// always returns ErrBufferUnsupported.
+func (this *MultiConsumerBuffer) ReadRune() (rune, int, error) {
+	return 0, 0, ErrBufferUnsupported
+}
+
+// UnreadRune is not supported, see UnreadByte.
+func (this *MultiConsumerBuffer) UnreadRune() error {
+	return ErrBufferUnsupported
+}
+
+// ReadSlice is not supported, since it has to look ahead for delim. It always returns
+// ErrBufferUnsupported, as do ReadLine, ReadBytes and ReadString.
+func (this *MultiConsumerBuffer) ReadSlice(delim byte) ([]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+func (this *MultiConsumerBuffer) ReadLine() ([]byte, bool, error) {
+	return nil, false, ErrBufferUnsupported
+}
+
+func (this *MultiConsumerBuffer) ReadBytes(delim byte) ([]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+func (this *MultiConsumerBuffer) ReadString(delim byte) (string, error) {
+	return "", ErrBufferUnsupported
+}
+
+// Mark is not supported, since there's no single consumer position to go back to. It
+// always returns -1, which Rewind and Unmark reject with ErrBufferUnsupported.
+func (this *MultiConsumerBuffer) Mark() int64 {
+	return -1
+}
+
+func (this *MultiConsumerBuffer) Rewind(mark int64) error {
+	return ErrBufferUnsupported
+}
+
+func (this *MultiConsumerBuffer) Unmark(mark int64) error {
+	return ErrBufferUnsupported
+}
+
+// take claims up to n bytes of data for the calling consumer, and returns where they
+// start and how many there are. If there is no data, it waits for the producers if
+// block is true, or returns ErrBufferWouldBlock otherwise.
+func (this *MultiConsumerBuffer) take(ctx context.Context, n int64, block bool) (int64, int64, error) {
+	for {
+		// Check for close before looking at the data so anything written before Close
+		// or CloseWrite is still returned.
+		werr := this.werr.get()
+		done := atomic.LoadInt64(&this.done) == 1
+
+		cpos := this.cseq.getClaim()
+		ppos := this.pseq.get()
+
+		if cpos >= ppos {
+			if !block {
+				if werr != nil {
+					return 0, 0, werr
+				}
+
+				if done {
+					return 0, 0, io.EOF
+				}
+
+				return 0, 0, ErrBufferWouldBlock
+			}
+
+			atomic.AddInt64(&this.cwait, 1)
+
+			if err := this.waitForData(ctx, cpos); err != nil {
+				return 0, 0, err
+			}
+
+			continue
+		}
+
+		m := ppos - cpos
+		if m > n {
+			m = n
+		}
+
+		// If another consumer got here first, start over from its claim.
+		if this.cseq.casClaim(cpos, cpos+m) {
+			return cpos, m, nil
+		}
+	}
+}
+
+// release lets the producers reuse the m bytes claimed at start, once all the consumers
+// that claimed data before it have released theirs.
+func (this *MultiConsumerBuffer) release(start, m int64) {
+	// Every release signals, so wait for the earlier claims like any other consumer.
+	if this.cseq.get() != start {
+		this.waiter.Wait(func() bool {
+			return this.cseq.get() == start
+		})
+	}
+
+	this.cseq.set(start + m)
+	this.signal()
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestMultiConsumerBufferConsumerProducerRead(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testRead(t, buf)
+}
+
+func TestMultiConsumerBufferConsumerProducerCloseWrite(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWrite(t, buf)
+}
+
+func TestMultiConsumerBufferCommitBytes(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	fillBuffer(t, buf, 2048)
+
+	testCommit(t, buf)
+
+	_, err = buf.Peek(10)
+
+	assert.Equal(t, true, ErrBufferUnsupported, err)
+
+	_, err = buf.ReadSlice('\n')
+
+	assert.Equal(t, true, ErrBufferUnsupported, err)
+
+	assert.Equal(t, true, ErrBufferUnsupported, buf.Rewind(buf.Mark()))
+}
+
+func TestMultiConsumerBufferConcurrentRead(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	// Each producer writes messages filled with its own ID, and each consumer reads
+	// one message at a time. Every message must arrive whole, and exactly once.
+	producers, consumers, messages, size := 4, 4, 1000, 64
+
+	var pwg, cwg sync.WaitGroup
+
+	for i := 0; i < producers; i++ {
+		pwg.Add(1)
+
+		go func(id byte) {
+			defer pwg.Done()
+
+			p := make([]byte, size)
+			for j := range p {
+				p[j] = id
+			}
+
+			for j := 0; j < messages; j++ {
+				_, err := buf.Write(p)
+
+				assert.NoError(t, true, err)
+			}
+		}(byte(i))
+	}
+
+	go func() {
+		pwg.Wait()
+		buf.CloseWrite()
+	}()
+
+	counts := make([]int64, producers)
+
+	for i := 0; i < consumers; i++ {
+		cwg.Add(1)
+
+		go func() {
+			defer cwg.Done()
+
+			p := make([]byte, size)
+
+			for {
+				n, err := buf.Read(p)
+				if err == io.EOF {
+					return
+				}
+
+				assert.NoError(t, true, err)
+				assert.Equal(t, true, size, n)
+
+				for j := range p {
+					assert.Equal(t, true, p[0], p[j])
+				}
+
+				atomic.AddInt64(&counts[p[0]], 1)
+			}
+		}()
+	}
+
+	cwg.Wait()
+
+	for i := range counts {
+		assert.Equal(t, true, int64(messages), counts[i])
+	}
+}
+
+func TestMultiConsumerBufferConcurrentTryRead(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	_, err = buf.Write([]byte{'a'})
+
+	assert.NoError(t, true, err)
+
+	// Only one of the consumers gets the byte, and none of the others may wait for it.
+	consumers := 8
+
+	var wg sync.WaitGroup
+
+	got, empty := int64(0), int64(0)
+
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			p := make([]byte, 1)
+
+			n, err := buf.TryRead(p)
+			if err == ErrBufferWouldBlock {
+				atomic.AddInt64(&empty, 1)
+				return
+			}
+
+			assert.NoError(t, true, err)
+			assert.Equal(t, true, 1, n)
+			assert.Equal(t, true, byte('a'), p[0])
+
+			atomic.AddInt64(&got, 1)
+		}()
+	}
+
+	ch := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	assert.True(t, true, fired(ch, time.Second))
+	assert.Equal(t, true, int64(1), got)
+	assert.Equal(t, true, int64(consumers-1), empty)
+}
+
+// blockingWriter blocks every Write until unblock is closed.
+type blockingWriter struct {
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (this *blockingWriter) Write(p []byte) (int, error) {
+	close(this.entered)
+	<-this.unblock
+	return len(p), io.ErrShortWrite
+}
+
+func TestMultiConsumerBufferWriteToDoesNotHoldClaim(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	_, err = buf.Write([]byte{'a'})
+
+	assert.NoError(t, true, err)
+
+	w := &blockingWriter{
+		entered: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+
+	go buf.WriteTo(w)
+
+	assert.True(t, true, fired(w.entered, time.Second))
+
+	// While WriteTo is stuck in w, other consumers must still be able to read.
+	_, err = buf.Write([]byte{'b'})
+
+	assert.NoError(t, true, err)
+
+	ch := make(chan struct{})
+
+	go func() {
+		defer close(ch)
+
+		p := make([]byte, 1)
+
+		n, err := buf.Read(p)
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, 1, n)
+		assert.Equal(t, true, byte('b'), p[0])
+	}()
+
+	assert.True(t, true, fired(ch, time.Second))
+
+	close(w.unblock)
+}
+
+func TestMultiConsumerBufferReadableClaimed(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	_, err = buf.Write(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+
+	// Data claimed by a read that's still in progress isn't there to read
+	start, m, err := buf.take(context.Background(), 100, false)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 0, buf.Len())
+
+	readable := buf.Readable()
+
+	assert.False(t, true, fired(readable, 10*time.Millisecond))
+
+	buf.release(start, m)
+
+	assert.False(t, true, fired(readable, 10*time.Millisecond))
+
+	_, err = buf.Write(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+	assert.True(t, true, fired(readable, 0))
+}
+
+func TestMultiConsumerBufferWatermarksConcurrent(t *testing.T) {
+	buf, err := NewMultiConsumerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testWatermarksConcurrent(t, buf)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// MultiProducerBuffer is a Buffer that any number of goroutines can write to at the same
+// time. Each write claims space for all of its bytes by moving the producer claim with a
+// CAS, so it lands in the buffer contiguously and in one piece, never interleaved with
+// other writes. Writes become visible to the consumer in the order they claimed their
+// space. There can still only be one consumer.
+type MultiProducerBuffer struct {
+	*Buffer
+}
+
+var _ RingBuffer = (*MultiProducerBuffer)(nil)
+
+func NewMultiProducerBuffer(size int64) (*MultiProducerBuffer, error) {
+	o, err := newOptions(WithSize(size), WithKind(MultiProducerKind))
+	if err != nil {
+		return nil, err
+	}
+
+	return newMultiProducerBuffer(o), nil
+}
+
+func newMultiProducerBuffer(o *options) *MultiProducerBuffer {
+	this := &MultiProducerBuffer{
+		Buffer: newBuffer(o),
+	}
+
+	this.freeFn = this.Free
+
+	return this
+}
+
+// Free returns the number of bytes that can be written without waiting for the
+// consumer. Space claimed by writes that are still in progress doesn't count as free.
+func (this *MultiProducerBuffer) Free() int {
+	return int(this.size - (this.pseq.getClaim() - this.released()))
+}
+
+func (this *MultiProducerBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return this.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but gives up waiting for buffer space once ctx is
+// done, in which case ctx.Err() is returned. Since other producers may claim the space
+// right after ours, r can't read straight into the buffer, as a short read would leave
+// a gap. Instead, each read of up to the read block size is copied in with one Write.
+func (this *MultiProducerBuffer) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	return readFrom(ctx, this, r, this.rbsize)
+}
+
+// Write copies p into the buffer, waiting for the consumer to make space if needed. It's
+// safe to call from many goroutines at once. Since p is written in one piece, it can't
+// be larger than the buffer, or the error is bufio.ErrBufferFull.
+func (this *MultiProducerBuffer) Write(p []byte) (int, error) {
+	return this.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but gives up waiting for buffer space once ctx is done,
+// in which case nothing is written and ctx.Err() is returned.
+func (this *MultiProducerBuffer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	start, err := this.claim(ctx, int64(len(p)), true)
+	if err != nil {
+		return 0, err
+	}
+
+	return this.publish(start, p), nil
+}
+
+// TryWrite is the non-blocking version of Write. Since p is written in one piece, it
+// either writes all of p, or nothing and returns ErrBufferWouldBlock.
+func (this *MultiProducerBuffer) TryWrite(p []byte) (int, error) {
+	start, err := this.claim(context.Background(), int64(len(p)), false)
+	if err != nil {
+		return 0, err
+	}
+
+	return this.publish(start, p), nil
+}
+
+// Reserve is not supported, since a reservation can't be tied to the producer that made
+// it. It always returns ErrBufferUnsupported.
+func (this *MultiProducerBuffer) Reserve(n int) ([][]byte, error) {
+	return nil, ErrBufferUnsupported
+}
+
+// Publish is not supported, see Reserve. It always returns ErrBufferUnsupported.
+func (this *MultiProducerBuffer) Publish(n int) (int, error) {
+	return 0, ErrBufferUnsupported
+}
+
+// WriteString is like Write, but writes the contents of s.
+func (this *MultiProducerBuffer) WriteString(s string) (int, error) {
+	return this.Write([]byte(s))
+}
+
+// WriteByte writes a single byte.
+func (this *MultiProducerBuffer) WriteByte(c byte) error {
+	_, err := this.Write([]byte{c})
+	return err
+}
+
+// WriteRune writes the UTF-8 encoding of r, and returns the number of bytes written.
+func (this *MultiProducerBuffer) WriteRune(r rune) (int, error) {
+	if r < utf8.RuneSelf {
+		return 1, this.WriteByte(byte(r))
+	}
+
+	var p [utf8.UTFMax]byte
+
+	n := utf8.EncodeRune(p[:], r)
+	return this.Write(p[:n])
+}
+
+// claim claims n bytes of space for the calling producer, and returns where it starts.
+// If there isn't enough space, it waits for the consumer if block is true, or returns
+// ErrBufferWouldBlock otherwise.
+func (this *MultiProducerBuffer) claim(ctx context.Context, n int64, block bool) (int64, error) {
+	if n > this.size {
+		return 0, bufio.ErrBufferFull
+	}
+
+	for {
+		if this.werr.get() != nil {
+			return 0, io.ErrClosedPipe
+		}
+
+		// Unlike the single producer, we can't cache the consumer position in
+		// pseq.gate, since all the producers would be writing it.
+		start := this.pseq.getClaim()
+		wrap := start + n - this.size
+
+		if wrap > this.released() {
+			if !block {
+				if atomic.LoadInt64(&this.done) == 1 {
+					return 0, io.EOF
+				}
+
+				return 0, ErrBufferWouldBlock
+			}
+
+			atomic.AddInt64(&this.pwait, 1)
+
+			err := this.wait(ctx, &this.wdeadline, func() bool {
+				return wrap <= this.released()
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		// If another producer got here first, start over from its claim.
+		if this.pseq.casClaim(start, start+n) {
+			this.waitUnpinned(start + n)
+			return start, nil
+		}
+	}
+}
+
+// publish copies p into the space claimed at start, and makes it visible to the
+// consumer once all the writes that claimed space before it are visible.
+func (this *MultiProducerBuffer) publish(start int64, p []byte) int {
+	total := ringCopy(this.buf, p, start&this.mask)
+
+	// Every publish signals, so wait for the earlier writes like any other producer.
+	if this.pseq.get() != start {
+		this.waiter.Wait(func() bool {
+			return this.pseq.get() == start
+		})
+	}
+
+	this.pseq.set(start + int64(len(p)))
+	this.signal()
+
+	return total
+}
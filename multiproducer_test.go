@@ -0,0 +1,188 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestMultiProducerBufferConsumerProducerRead(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testRead(t, buf)
+}
+
+func TestMultiProducerBufferConsumerProducerCloseWrite(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWrite(t, buf)
+}
+
+func TestMultiProducerBufferCloseWithError(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testCloseWithError(t, buf)
+}
+
+func TestMultiProducerBufferReadAt(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAt(t, buf)
+}
+
+func TestMultiProducerBufferReadAtConcurrent(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	testReadAtConcurrent(t, buf)
+}
+
+func TestMultiProducerBufferConcurrentWrite(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	// Each producer writes messages filled with its own ID. Since writes are contiguous
+	// and atomic, every message the consumer reads must be all one byte.
+	producers, messages, size := 8, 1000, 100
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+
+		go func(id byte) {
+			defer wg.Done()
+
+			p := make([]byte, size)
+			for j := range p {
+				p[j] = id
+			}
+
+			for j := 0; j < messages; j++ {
+				n, err := buf.Write(p)
+
+				assert.NoError(t, true, err)
+				assert.Equal(t, true, size, n)
+			}
+		}(byte(i))
+	}
+
+	go func() {
+		wg.Wait()
+		buf.CloseWrite()
+	}()
+
+	counts := make([]int, producers)
+	p := make([]byte, size)
+
+	for {
+		_, err := io.ReadFull(buf, p)
+		if err == io.EOF {
+			break
+		}
+
+		assert.NoError(t, true, err)
+
+		for j := range p {
+			assert.Equal(t, true, p[0], p[j])
+		}
+
+		counts[p[0]]++
+	}
+
+	for i := range counts {
+		assert.Equal(t, true, messages, counts[i])
+	}
+}
+
+func TestMultiProducerBufferTryWrite(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	n, err := buf.TryWrite(make([]byte, 4000))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4000, n)
+	assert.Equal(t, true, 96, buf.Free())
+
+	// Writes are never split, so this doesn't write the 96 bytes that would fit
+	n, err = buf.TryWrite(make([]byte, 100))
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 0, n)
+
+	n, err = buf.Write(make([]byte, 4097))
+
+	assert.Equal(t, true, bufio.ErrBufferFull, err)
+	assert.Equal(t, true, 0, n)
+
+	_, err = buf.Reserve(10)
+
+	assert.Equal(t, true, ErrBufferUnsupported, err)
+
+	n, err = buf.Discard(100)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+
+	n, err = buf.TryWrite(make([]byte, 100))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 100, n)
+	assert.Equal(t, true, 96, buf.Free())
+}
+
+func TestMultiProducerBufferWritableClaimed(t *testing.T) {
+	buf, err := NewMultiProducerBuffer(4096)
+
+	assert.NoError(t, true, err)
+
+	// Space claimed by a write that's still in progress isn't free
+	start, err := buf.claim(context.Background(), 4096, false)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 0, buf.Free())
+
+	writable := buf.Writable()
+
+	assert.False(t, true, fired(writable, 10*time.Millisecond))
+
+	buf.publish(start, make([]byte, 4096))
+
+	assert.False(t, true, fired(writable, 10*time.Millisecond))
+
+	_, err = buf.Discard(100)
+
+	assert.NoError(t, true, err)
+	assert.True(t, true, fired(writable, 0))
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/dataence/bithacks"
+)
+
+// Kind selects the RingBuffer implementation created by NewRingBuffer.
+type Kind int
+
+const (
+	// LockKind creates a Buffer that waits with a BlockingWait by default.
+	LockKind Kind = iota
+
+	// LockFreeKind creates a Buffer that waits with a YieldingWait by default.
+	LockFreeKind
+
+	// MultiProducerKind creates a MultiProducerBuffer, which many goroutines can write
+	// to at the same time.
+	MultiProducerKind
+
+	// MultiConsumerKind creates a MultiConsumerBuffer, which many goroutines can write
+	// to and read from at the same time.
+	MultiConsumerKind
+)
+
+// Option configures a RingBuffer created by NewRingBuffer.
+type Option func(*options)
+
+type options struct {
+	kind Kind
+
+	// How the producer and consumer wait for each other, nil for the kind's default
+	wait WaitStrategy
+
+	// Buffer size, must be a power of two
+	size int64
+
+	// Number of bytes ReadFrom waits for before reading, and WriteTo writes at a time
+	readBlockSize  int
+	writeBlockSize int
+
+	// Most bytes ReadFrom reads at a time, 0 if there's no limit
+	maxReadSize int
+}
+
+// WithKind selects the implementation. The default is LockKind.
+func WithKind(kind Kind) Option {
+	return func(o *options) {
+		o.kind = kind
+	}
+}
+
+// WithWaitStrategy sets how the producer and consumer wait for each other, e.g., to
+// trade latency for CPU cost. The default is a BlockingWait for LockKind, and a
+// YieldingWait otherwise. A WaitStrategy can be shared by several buffers, but then
+// signaling one of them wakes up the waiters of all of them.
+func WithWaitStrategy(wait WaitStrategy) Option {
+	return func(o *options) {
+		o.wait = wait
+	}
+}
+
+// WithSize sets the buffer size, which must be a power of two. The default is 1 MB.
+func WithSize(size int64) Option {
+	return func(o *options) {
+		o.size = size
+	}
+}
+
+// WithReadBlockSize sets how much free space ReadFrom waits for before reading from
+// its reader. The buffer must be at least twice as large. The default is 1 KB.
+func WithReadBlockSize(n int) Option {
+	return func(o *options) {
+		o.readBlockSize = n
+	}
+}
+
+// WithMaxReadSize caps how much ReadFrom reads from its reader at a time. Otherwise,
+// each read fills all the free space up to the end of the buffer. The default is 0,
+// which means there's no limit.
+func WithMaxReadSize(n int) Option {
+	return func(o *options) {
+		o.maxReadSize = n
+	}
+}
+
+// WithWriteBlockSize sets how much WriteTo writes to its writer at a time. It can't be
+// larger than the buffer. The default is 2 KB.
+func WithWriteBlockSize(n int) Option {
+	return func(o *options) {
+		o.writeBlockSize = n
+	}
+}
+
+// NewRingBuffer creates a RingBuffer configured by opts. Without any options, it's the
+// same as NewLockBuffer(0).
+func NewRingBuffer(opts ...Option) (RingBuffer, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.kind {
+	case LockKind, LockFreeKind:
+		return newBuffer(o), nil
+
+	case MultiProducerKind:
+		return newMultiProducerBuffer(o), nil
+
+	case MultiConsumerKind:
+		return newMultiConsumerBuffer(o), nil
+	}
+
+	return nil, fmt.Errorf("Unknown kind %d.", o.kind)
+}
+
+// newOptions applies opts on top of the defaults, and makes sure the result is valid.
+func newOptions(opts ...Option) (*options, error) {
+	o := &options{
+		kind:           LockKind,
+		size:           defaultBufferSize,
+		readBlockSize:  defaultReadBlockSize,
+		writeBlockSize: defaultWriteBlockSize,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.size < 0 || o.readBlockSize < 0 || o.writeBlockSize < 0 || o.maxReadSize < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+
+	if o.size == 0 {
+		o.size = defaultBufferSize
+	}
+
+	if o.readBlockSize == 0 {
+		o.readBlockSize = defaultReadBlockSize
+	}
+
+	if o.writeBlockSize == 0 {
+		o.writeBlockSize = defaultWriteBlockSize
+	}
+
+	if o.wait == nil {
+		if o.kind == LockKind {
+			o.wait = NewBlockingWait()
+		} else {
+			o.wait = NewYieldingWait()
+		}
+	}
+
+	if !bithacks.PowerOfTwo64(o.size) {
+		return nil, fmt.Errorf("Size must be power of two. Try %d.", bithacks.RoundUpPowerOfTwo64(o.size))
+	}
+
+	if o.size < 2*int64(o.readBlockSize) {
+		return nil, fmt.Errorf("Size must at least be %d. Try %d.", 2*o.readBlockSize, bithacks.RoundUpPowerOfTwo64(2*int64(o.readBlockSize)))
+	}
+
+	if int64(o.writeBlockSize) > o.size {
+		return nil, fmt.Errorf("Write block size must be at most %d.", o.size)
+	}
+
+	return o, nil
+}
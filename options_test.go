@@ -0,0 +1,99 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestNewRingBuffer(t *testing.T) {
+	buf, err := NewRingBuffer()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, defaultBufferSize, buf.Cap())
+
+	b, ok := buf.(*Buffer)
+
+	assert.True(t, true, ok)
+
+	_, ok = b.waiter.(*BlockingWait)
+
+	assert.True(t, true, ok)
+
+	buf, err = NewRingBuffer(WithKind(LockFreeKind), WithSize(4096))
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 4096, buf.Cap())
+
+	b, ok = buf.(*Buffer)
+
+	assert.True(t, true, ok)
+
+	_, ok = b.waiter.(*YieldingWait)
+
+	assert.True(t, true, ok)
+
+	// Smaller blocks allow for a smaller buffer
+	buf, err = NewRingBuffer(WithSize(256), WithReadBlockSize(64), WithWriteBlockSize(128))
+
+	assert.NoError(t, true, err)
+
+	go func() {
+		fillBuffer(t, buf, 1000)
+		buf.CloseWrite()
+	}()
+
+	m, err := buf.WriteTo(bytes.NewBuffer(nil))
+
+	assert.Equal(t, true, io.EOF, err)
+	assert.Equal(t, true, 1000, m)
+}
+
+func TestNewRingBufferInvalid(t *testing.T) {
+	_, err := NewRingBuffer(WithSize(-1))
+
+	assert.Equal(t, true, bufio.ErrNegativeCount, err)
+
+	_, err = NewRingBuffer(WithSize(5000))
+
+	assert.Error(t, true, err)
+
+	_, err = NewRingBuffer(WithSize(4096), WithReadBlockSize(4096))
+
+	assert.Error(t, true, err)
+
+	_, err = NewRingBuffer(WithSize(4096), WithWriteBlockSize(8192))
+
+	assert.Error(t, true, err)
+
+	_, err = NewRingBuffer(WithKind(Kind(100)))
+
+	assert.Error(t, true, err)
+}
+
+func TestNewRingBufferMaxReadSize(t *testing.T) {
+	for _, kind := range []Kind{LockKind, LockFreeKind} {
+		buf, err := NewRingBuffer(WithKind(kind), WithSize(4096), WithMaxReadSize(512))
+
+		assert.NoError(t, true, err)
+
+		testReadFromSpan(t, buf, 512)
+	}
+}
@@ -0,0 +1,1652 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dataence/glog"
+)
+
+// Buffer is the ring buffer behind every RingBuffer in this package. It has a single
+// producer and a single consumer, and waits for the other side using a WaitStrategy,
+// so the same buffer can trade latency for CPU cost as needed.
+type Buffer struct {
+	id int32
+
+	buf []byte
+	tmp []byte
+
+	size int64
+	mask int64
+
+	// Number of bytes ReadFrom waits for before reading, and WriteTo writes at a time
+	rbsize int
+	wbsize int
+
+	// Most bytes ReadFrom reads at a time, 0 if there's no limit
+	maxread int64
+
+	done int64
+
+	// Set once the producer is done writing, see CloseWithError
+	werr closeError
+
+	// Read and write deadlines in nanoseconds since the epoch, 0 if not set
+	rdeadline int64
+	wdeadline int64
+
+	pseq *sequence
+	cseq *sequence
+
+	cwait int64
+	pwait int64
+
+	// How the producer and consumer wait for each other
+	waiter WaitStrategy
+
+	// Bytes reserved by the producer but not yet published, see Reserve
+	reserved int64
+
+	// Position of the oldest byte the consumer still holds on to after reading it,
+	// or -1 if none, see hold
+	held int64
+
+	// The last byte and rune read, for UnreadByte and UnreadRune; -1 if invalid
+	lastByte     int
+	lastRuneSize int
+
+	// Active marks, oldest first, and the oldest one for the producer's benefit, or
+	// -1 if there are none, see Mark
+	marks  []int64
+	marked int64
+
+	// Position of the bytes ReadAt is copying, or -1 if none, so the producer doesn't
+	// overwrite them, and for the producer, how many ReadAt calls are pinning bytes
+	// anywhere, see waitUnpinned. pinmu keeps concurrent ReadAt calls apart.
+	pinned int64
+	pins   int32
+	pinmu  sync.Mutex
+
+	// For the producer of a BroadcastBuffer, the consumers it has to wait for, as a
+	// []*Buffer, see released
+	readers atomic.Value
+
+	// For a BroadcastConsumer, the consumers it has to wait for, see barrier, and the
+	// producer's buffer, see signal
+	deps []*Buffer
+	root *Buffer
+
+	// Channels returned by Readable, Writable and Done that haven't fired yet, and how
+	// many there are, see notify
+	wmu      sync.Mutex
+	watchers int32
+	readable []chan struct{}
+	writable []chan struct{}
+	donech   chan struct{}
+
+	// Hooks registered with OnHighWater and OnLowWater, as a []*watermark, and the lock
+	// that makes them see every change to Len() in order, see notify
+	wmarks atomic.Value
+	hookmu sync.Mutex
+
+	// Len and Free of the MultiProducerBuffer or MultiConsumerBuffer that embeds this
+	// Buffer, since notify can't reach their overrides otherwise. nil for the others.
+	lenFn  func() int
+	freeFn func() int
+}
+
+// LockBuffer is a Buffer that blocks on a sync.Cond while waiting.
+//
+// Deprecated: Use a Buffer with a BlockingWait instead.
+type LockBuffer = Buffer
+
+// LockFreeBuffer is a Buffer that yields the processor while waiting.
+//
+// Deprecated: Use a Buffer with a YieldingWait instead.
+type LockFreeBuffer = Buffer
+
+// NewLockBuffer creates a Buffer of the given size that waits with a BlockingWait.
+func NewLockBuffer(size int64) (*Buffer, error) {
+	o, err := newOptions(WithSize(size), WithKind(LockKind))
+	if err != nil {
+		return nil, err
+	}
+
+	return newBuffer(o), nil
+}
+
+// NewLockFreeBuffer creates a Buffer of the given size that waits with a YieldingWait.
+func NewLockFreeBuffer(size int64) (*Buffer, error) {
+	o, err := newOptions(WithSize(size), WithKind(LockFreeKind))
+	if err != nil {
+		return nil, err
+	}
+
+	return newBuffer(o), nil
+}
+
+func newBuffer(o *options) *Buffer {
+	return &Buffer{
+		id:     atomic.AddInt32(&bufcnt, 1),
+		buf:    make([]byte, o.size),
+		size:   o.size,
+		mask:   o.size - 1,
+		pseq:   newSequence(),
+		cseq:   newSequence(),
+		cwait:  0,
+		pwait:  0,
+		waiter: o.wait,
+
+		held:         -1,
+		lastByte:     -1,
+		lastRuneSize: -1,
+		marked:       -1,
+		pinned:       -1,
+
+		rbsize:  o.readBlockSize,
+		wbsize:  o.writeBlockSize,
+		maxread: int64(o.maxReadSize),
+	}
+}
+
+func (this *Buffer) ID() int32 {
+	return this.id
+}
+
+func (this *Buffer) Close() error {
+	atomic.StoreInt64(&this.done, 1)
+	this.signal()
+	return nil
+}
+
+// CloseWrite signals the end of the stream. Unlike Close, the consumer can still read
+// everything that has been written, and only gets io.EOF after that. Any write after
+// CloseWrite returns io.ErrClosedPipe.
+func (this *Buffer) CloseWrite() error {
+	return this.CloseWithError(nil)
+}
+
+// CloseWithError is like CloseWrite, except the consumer gets err instead of io.EOF once
+// it has read everything. This lets the consumer tell a clean shutdown apart from, e.g.,
+// a connection reset. A nil err is the same as io.EOF. Only the first close counts.
+func (this *Buffer) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+
+	this.werr.close(err)
+	this.signal()
+	return nil
+}
+
+// SetDeadline sets both the read and write deadlines, same as calling SetReadDeadline
+// and SetWriteDeadline.
+func (this *Buffer) SetDeadline(t time.Time) error {
+	this.SetReadDeadline(t)
+	this.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read, Peek and WriteTo calls that are waiting
+// for data, including the ones already waiting. Once the deadline passes, they return
+// ErrBufferTimeout. A zero t means no deadline.
+func (this *Buffer) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&this.rdeadline, deadlineNano(t))
+	this.signal()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write and ReadFrom calls that are waiting for
+// buffer space, including the ones already waiting. Once the deadline passes, they
+// return ErrBufferTimeout. A zero t means no deadline.
+func (this *Buffer) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&this.wdeadline, deadlineNano(t))
+	this.signal()
+	return nil
+}
+
+func (this *Buffer) Len() int {
+	cpos := this.cseq.get()
+	ppos := this.barrier()
+	return int(ppos - cpos)
+}
+
+// Cap returns the size of the buffer.
+func (this *Buffer) Cap() int {
+	return int(this.size)
+}
+
+// Free returns the number of bytes that can be written without waiting for the
+// consumer. It can be less than Cap() - Len() while the consumer holds on to bytes it
+// has already read, e.g., after ReadSlice.
+func (this *Buffer) Free() int {
+	return int(this.size - (this.pseq.get() - this.released()))
+}
+
+// Produced returns the total number of bytes written to the buffer since it was
+// created or last reset. It's the producer position in the stream.
+func (this *Buffer) Produced() int64 {
+	return this.pseq.get()
+}
+
+// Consumed returns the total number of bytes read from the buffer since it was
+// created or last reset. It's the consumer position in the stream.
+func (this *Buffer) Consumed() int64 {
+	return this.cseq.get()
+}
+
+// Reset empties the buffer and puts it back into the state it was created in, so it
+// can be reused, e.g., for a new connection. The ID stays the same. It must not be
+// called while the buffer is in use by anyone else. Channels returned by Readable,
+// Writable and Done that haven't fired yet fire, so nobody is left waiting on them.
+func (this *Buffer) Reset() {
+	this.pseq.set(0)
+	this.pseq.gate = 0
+	this.pseq.setClaim(0)
+	this.cseq.set(0)
+	this.cseq.gate = 0
+	this.cseq.setClaim(0)
+
+	atomic.StoreInt64(&this.done, 0)
+	this.werr = closeError{}
+
+	atomic.StoreInt64(&this.rdeadline, 0)
+	atomic.StoreInt64(&this.wdeadline, 0)
+
+	this.tmp = this.tmp[0:0]
+	this.reserved = 0
+
+	atomic.StoreInt64(&this.held, -1)
+	this.lastByte = -1
+	this.lastRuneSize = -1
+
+	this.marks = this.marks[0:0]
+	atomic.StoreInt64(&this.marked, -1)
+	atomic.StoreInt64(&this.pinned, -1)
+	atomic.StoreInt32(&this.pins, 0)
+
+	this.wmu.Lock()
+
+	// Whoever is still waiting on a channel from before the Reset would never hear
+	// from the buffer again, so let them all go, as if it had been closed.
+	fire(this.readable)
+	fire(this.writable)
+
+	if this.donech != nil {
+		select {
+		case <-this.donech:
+		default:
+			close(this.donech)
+		}
+	}
+
+	this.readable = nil
+	this.writable = nil
+	this.donech = nil
+	atomic.StoreInt32(&this.watchers, 0)
+
+	this.hookmu.Lock()
+	if wmarks, ok := this.wmarks.Load().([]*watermark); ok {
+		for _, w := range wmarks {
+			w.above = false
+		}
+	}
+	this.hookmu.Unlock()
+	this.wmu.Unlock()
+
+	this.cwait = 0
+	this.pwait = 0
+}
+
+func (this *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	return this.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but gives up waiting for buffer space once ctx is
+// done, in which case ctx.Err() is returned. A call to r.Read that is already blocked
+// is not interrupted.
+func (this *Buffer) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	total := int64(0)
+	//p := make([]byte, defaultReadBlockSize)
+
+	for {
+		start, _, err := this.waitForWriteSpace(ctx, this.rbsize)
+		if err != nil {
+			return total, err
+		}
+
+		// We only waited for rbsize bytes, but there may be a lot more space than that.
+		// Let the reader fill all of it up to the end of the buffer, so it takes fewer
+		// calls to r.Read to move the same amount of data.
+		cnt := this.released() + this.size - start
+		if this.maxread > 0 && cnt > this.maxread {
+			cnt = this.maxread
+		}
+
+		pstart := int64(start) & this.mask
+		pend := pstart + int64(cnt)
+		if pend > int64(len(this.buf)) {
+			pend = int64(len(this.buf))
+		}
+
+		this.pseq.setClaim(start + pend - pstart)
+		this.waitUnpinned(start + pend - pstart)
+
+		//glog.Debugf("%d: got buffer at %d for %d bytes, %d bytes to buffer end", this.ID(), start, cnt, len(this.buf[pstart:]))
+
+		n, err := r.Read(this.buf[pstart:pend])
+		//glog.Debugf("%d: Read %d bytes", this.ID(), n)
+
+		if n > 0 {
+			this.pseq.set(start + int64(n))
+			this.signal()
+			//m, err := this.Write(p[:n])
+			//glog.Debugf("Wrote %d bytes", m)
+			total += int64(n)
+
+			//if err != nil {
+			//	return total, err
+			//}
+		}
+
+		if err != nil {
+			//glog.Debugf("Error = %v", err)
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+func (this *Buffer) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(this, w, this.wbsize)
+}
+
+func (this *Buffer) Read(p []byte) (int, error) {
+	return this.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but gives up waiting for data once ctx is done, in which
+// case ctx.Err() is returned.
+func (this *Buffer) ReadContext(ctx context.Context, p []byte) (int, error) {
+	this.unhold()
+
+	pl := int64(len(p))
+
+	// glog.Debugf("reading %d bytes", pl)
+
+	for {
+		cpos := this.cseq.get()
+		ppos := this.barrier()
+		cindex := cpos & this.mask
+
+		//glog.Debugf("cpos = %d, ppos = %d, cindex = %d, len(p) = %d", cpos, ppos, cindex, pl)
+
+		// If consumer position is at least len(p) less than producer position, that means
+		// we have enough data to fill p. There are two scenarios that could happen:
+		// 1. cindex + len(p) < buffer size, in this case, we can just copy() data from
+		//    buffer to p, and copy will just copy enough to fill p and stop.
+		//    The number of bytes copied will be len(p).
+		// 2. cindex + len(p) > buffer size, this means the data will wrap around to the
+		//    the beginning of the buffer. In thise case, we can also just copy data from
+		//    buffer to p, and copy will just copy until the end of the buffer and stop.
+		//    The number of bytes will NOT be len(p) but less than that.
+		if cpos+pl < ppos {
+			n := copy(p, this.buf[cindex:])
+
+			//glog.Debugf("copied %d bytes into p", n)
+
+			this.cseq.set(cpos + int64(n))
+			this.signal()
+			return n, nil
+		}
+
+		// If we got here, that means there's not len(p) data available, but there might
+		// still be data.
+
+		// If cpos < ppos, that means there's at least ppos-cpos bytes to read. Let's just
+		// send that back for now.
+		if cpos < ppos {
+			// n bytes available
+			b := ppos - cpos
+
+			// bytes copied
+			var n int
+
+			// if cindex+n < size, that means we can copy all n bytes into p.
+			// No wrapping in this case.
+			if cindex+b < this.size {
+				n = copy(p, this.buf[cindex:cindex+b])
+			} else {
+				// If cindex+n >= size, that means we can copy to the end of buffer
+				n = copy(p, this.buf[cindex:])
+			}
+
+			//glog.Debugf("copied %d bytes into p", n)
+
+			this.cseq.set(cpos + int64(n))
+			this.signal()
+			return n, nil
+		}
+
+		// If we got here, that means cpos >= ppos, which means there's no data available.
+		// If so, let's wait...
+
+		this.cwait++
+		if err := this.waitForData(ctx, cpos); err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, nil
+}
+
+// Write copies p into the buffer, waiting for the consumer to make space if needed.
+// If p is larger than the buffer, it's written in pieces as space frees up, so the
+// consumer can see the first part of it before the rest is written.
+func (this *Buffer) Write(p []byte) (int, error) {
+	return this.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but gives up waiting for buffer space once ctx is done,
+// in which case ctx.Err() is returned. Nothing is written unless p is larger than the
+// buffer, in which case it returns the number of bytes written so far.
+func (this *Buffer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if int64(len(p)) > this.size {
+		return this.writeLarge(ctx, p)
+	}
+
+	start, _, err := this.waitForWriteSpace(ctx, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	// If we are here that means we now have enough space to write the full p.
+	// Let's copy from p into this.buf, starting at position ppos&this.mask.
+	total := ringCopy(this.buf, p, int64(start)&this.mask)
+
+	this.pseq.set(start + int64(len(p)))
+	this.signal()
+
+	glog.Debugf("Wrote %d bytes", total)
+
+	return total, nil
+}
+
+// Reserve is the producer's counterpart to Peek. It waits until there's space for n
+// bytes, and returns that space in the buffer so the caller can fill it in place instead
+// of copying it in with Write. The space is returned as one slice, or two if it wraps
+// around the end of the buffer. None of it is visible to the consumer until Publish is
+// called. Calling Reserve again, or writing to the buffer any other way, drops whatever
+// is left of the previous reservation.
+func (this *Buffer) Reserve(n int) ([][]byte, error) {
+	if int64(n) > this.size {
+		return nil, bufio.ErrBufferFull
+	}
+
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+
+	start, cnt, err := this.waitForWriteSpace(context.Background(), n)
+	if err != nil {
+		return nil, err
+	}
+
+	this.reserved = int64(cnt)
+
+	pstart := start & this.mask
+	pend := pstart + int64(cnt)
+
+	// Cap the slices so appending to them can't run into data that isn't reserved
+	if pend <= this.size {
+		return [][]byte{this.buf[pstart:pend:pend]}, nil
+	}
+
+	pend -= this.size
+
+	return [][]byte{this.buf[pstart:this.size:this.size], this.buf[0:pend:pend]}, nil
+}
+
+// Publish makes the first n bytes of the space returned by Reserve visible to the
+// consumer. It can be called more than once to publish the reserved space bit by bit.
+// If n is more than what's left of the reservation, nothing is published and the error
+// is ErrBufferInsufficientReserve.
+func (this *Buffer) Publish(n int) (int, error) {
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	if int64(n) > this.reserved {
+		return 0, ErrBufferInsufficientReserve
+	}
+
+	this.reserved -= int64(n)
+	this.pseq.set(this.pseq.get() + int64(n))
+	this.signal()
+	return n, nil
+}
+
+// WriteString is like Write, but writes the contents of s.
+func (this *Buffer) WriteString(s string) (int, error) {
+	return this.Write([]byte(s))
+}
+
+// WriteByte writes a single byte.
+func (this *Buffer) WriteByte(c byte) error {
+	_, err := this.Write([]byte{c})
+	return err
+}
+
+// WriteRune writes the UTF-8 encoding of r, and returns the number of bytes written.
+func (this *Buffer) WriteRune(r rune) (int, error) {
+	if r < utf8.RuneSelf {
+		return 1, this.WriteByte(byte(r))
+	}
+
+	var p [utf8.UTFMax]byte
+
+	n := utf8.EncodeRune(p[:], r)
+	return this.Write(p[:n])
+}
+
+// writeLarge writes p, which is larger than the buffer, a piece at a time. Each time
+// there's any space, it fills as much of it as it can.
+func (this *Buffer) writeLarge(ctx context.Context, p []byte) (int, error) {
+	total := 0
+
+	for total < len(p) {
+		start, _, err := this.waitForWriteSpace(ctx, 1)
+		if err != nil {
+			return total, err
+		}
+
+		n := this.released() + this.size - start
+		if n > int64(len(p)-total) {
+			n = int64(len(p) - total)
+		}
+
+		this.pseq.setClaim(start + n)
+		this.waitUnpinned(start + n)
+
+		ringCopy(this.buf, p[total:total+int(n)], start&this.mask)
+
+		this.pseq.set(start + n)
+		this.signal()
+
+		total += int(n)
+	}
+
+	return total, nil
+}
+
+// TryRead is the non-blocking version of Read. If there's no data to read, it returns
+// ErrBufferWouldBlock right away instead of waiting for the producer.
+func (this *Buffer) TryRead(p []byte) (int, error) {
+	// Check for close before looking at the data so anything written before Close or
+	// CloseWrite is still returned.
+	werr := this.closeErr()
+	done := atomic.LoadInt64(&this.done) == 1
+
+	if this.Len() == 0 {
+		if werr != nil {
+			return 0, werr
+		}
+
+		if done {
+			return 0, io.EOF
+		}
+
+		return 0, ErrBufferWouldBlock
+	}
+
+	// There's only one consumer, so the data can't go away and Read won't wait.
+	return this.Read(p)
+}
+
+// TryWrite is the non-blocking version of Write. It writes as much of p as there's
+// space for without waiting for the consumer. If that's less than len(p), it returns
+// the number of bytes written and ErrBufferWouldBlock.
+func (this *Buffer) TryWrite(p []byte) (int, error) {
+	if this.werr.get() != nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	free := int64(this.Free())
+
+	if free == 0 && len(p) > 0 {
+		if atomic.LoadInt64(&this.done) == 1 {
+			return 0, io.EOF
+		}
+
+		return 0, ErrBufferWouldBlock
+	}
+
+	if int64(len(p)) <= free {
+		return this.Write(p)
+	}
+
+	// There's only one producer, so the space can't go away and Write won't wait.
+	n, err := this.Write(p[:free])
+	if err != nil {
+		return n, err
+	}
+
+	return n, ErrBufferWouldBlock
+}
+
+// TryPeek is the non-blocking version of Peek. If there's no data to peek, it returns
+// ErrBufferWouldBlock right away instead of waiting for the producer.
+func (this *Buffer) TryPeek(n int) ([]byte, error) {
+	werr := this.closeErr()
+	done := atomic.LoadInt64(&this.done) == 1
+
+	if this.Len() == 0 {
+		if werr != nil {
+			return nil, werr
+		}
+
+		if done {
+			return nil, io.EOF
+		}
+
+		return nil, ErrBufferWouldBlock
+	}
+
+	return this.Peek(n)
+}
+
+// Description below is copied completely from bufio.Peek()
+//   http://golang.org/pkg/bufio/#Reader.Peek
+// Peek returns the next n bytes without advancing the reader. The bytes stop being valid
+// at the next read call. If Peek returns fewer than n bytes, it also returns an error
+// explaining why the read is short. The error is bufio.ErrBufferFull if n is larger than
+// b's buffer size.
+// If there's not enough data to peek, error is ErrBufferInsufficientData.
+// If n < 0, error is bufio.ErrNegativeCount
+// If the data wraps around the end of the buffer, it's copied into a slice that is
+// reused by the next Peek. Use PeekVec to avoid the copy.
+func (this *Buffer) Peek(n int) ([]byte, error) {
+	return this.PeekContext(context.Background(), n)
+}
+
+// PeekContext is like Peek, but gives up waiting for data once ctx is done, in which
+// case ctx.Err() is returned.
+func (this *Buffer) PeekContext(ctx context.Context, n int) ([]byte, error) {
+	cindex, m, err := this.peek(ctx, n)
+	if err != nil && err != ErrBufferInsufficientData {
+		return nil, err
+	}
+
+	// If cindex (index relative to buffer) + n is more than buffer size, that means
+	// the data wrapped
+	if cindex+m > this.size {
+		// reset the tmp buffer
+		this.tmp = this.tmp[0:0]
+
+		l := len(this.buf[cindex:])
+		this.tmp = append(this.tmp, this.buf[cindex:]...)
+		this.tmp = append(this.tmp, this.buf[0:m-int64(l)]...)
+		return this.tmp, err
+	}
+
+	return this.buf[cindex : cindex+m], err
+}
+
+// PeekVec is like Peek, except that data wrapping around the end of the buffer is
+// returned as two slices instead of being copied into one. Since the slices point
+// straight into the buffer, they stay valid until the consumer moves past them, and
+// are not affected by later calls to Peek or PeekVec.
+func (this *Buffer) PeekVec(n int) (net.Buffers, error) {
+	cindex, m, err := this.peek(context.Background(), n)
+	if err != nil && err != ErrBufferInsufficientData {
+		return nil, err
+	}
+
+	// Cap the slices so appending to them can't overwrite data that comes after
+	if cindex+m > this.size {
+		m -= this.size - cindex
+		return net.Buffers{this.buf[cindex:this.size:this.size], this.buf[0:m:m]}, err
+	}
+
+	return net.Buffers{this.buf[cindex : cindex+m : cindex+m]}, err
+}
+
+// peek waits until there's data available, and returns the index in the buffer where
+// it starts and how many of the n bytes requested are there. If that's less than n, the
+// error is ErrBufferInsufficientData.
+func (this *Buffer) peek(ctx context.Context, n int) (int64, int64, error) {
+	if int64(n) > this.size {
+		return 0, 0, bufio.ErrBufferFull
+	}
+
+	if n < 0 {
+		return 0, 0, bufio.ErrNegativeCount
+	}
+
+	//glog.Debugf("peeking %d bytes", n)
+
+	cpos := this.cseq.get()
+	ppos := this.barrier()
+
+	// If there's no data, then let's wait until there is some data
+	if cpos >= ppos {
+		if err := this.waitForData(ctx, cpos); err != nil {
+			return 0, 0, err
+		}
+
+		ppos = this.barrier()
+	}
+
+	// m = the number of bytes available. If m is more than what's requested (n),
+	// then we make m = n, basically peek max n bytes
+	m := ppos - cpos
+	err := error(nil)
+
+	if m >= int64(n) {
+		m = int64(n)
+	} else {
+		err = ErrBufferInsufficientData
+	}
+
+	return cpos & this.mask, m, err
+}
+
+// Commit moves the cursor forward by n bytes. It behaves like Read() except it doesn't
+// return any data. If there's enough data, then the cursor will be moved forward and
+// n will be returned. If there's not enough data, then the cursor will move forward
+// as much as possible, then return the number of positions (bytes) moved.
+func (this *Buffer) Commit(n int) (int, error) {
+	if int64(n) > this.size {
+		return 0, bufio.ErrBufferFull
+	}
+
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	this.unhold()
+
+	// Check for close first so we don't miss any data written right before it
+	werr := this.closeErr()
+
+	cpos := this.cseq.get()
+	ppos := this.barrier()
+
+	//glog.Debugf("cpos = %d, ppos = %d, cindex = %d, n = %d", cpos, ppos, cindex, n)
+
+	// If consumer position is at least n less than producer position, that means
+	// we have enough data to fill p. There are two scenarios that could happen:
+	// 1. cindex + n < buffer size, in this case, we can just copy() data from
+	//    buffer to p, and copy will just copy enough to fill p and stop.
+	//    The number of bytes copied will be len(p).
+	// 2. cindex + n > buffer size, this means the data will wrap around to the
+	//    the beginning of the buffer. In thise case, we can also just copy data from
+	//    buffer to p, and copy will just copy until the end of the buffer and stop.
+	//    The number of bytes will NOT be len(p) but less than that.
+	if cpos+int64(n) <= ppos {
+		//glog.Debugf("committing %d bytes", n)
+		this.cseq.set(cpos + int64(n))
+		this.signal()
+		return n, nil
+	}
+
+	// There's nothing left, and there never will be
+	if werr != nil && cpos >= ppos {
+		return 0, werr
+	}
+
+	return 0, ErrBufferInsufficientData
+}
+
+// Mark remembers the current position of the consumer, so it can go back to it later
+// with Rewind, e.g., when it finds out a frame it's parsing isn't complete yet. Until
+// the mark is released by Rewind or Unmark, the producer won't overwrite anything from
+// the mark on, even after it has been read, so don't hold on to it for too long. Marks
+// can be nested.
+func (this *Buffer) Mark() int64 {
+	cpos := this.cseq.get()
+
+	this.marks = append(this.marks, cpos)
+	atomic.StoreInt64(&this.marked, this.marks[0])
+	return cpos
+}
+
+// Rewind moves the consumer back to mark, so everything read since then can be read
+// again. It releases mark along with any marks made after it. If mark isn't active,
+// the error is ErrBufferInvalidMark.
+func (this *Buffer) Rewind(mark int64) error {
+	i := this.findMark(mark)
+	if i < 0 {
+		return ErrBufferInvalidMark
+	}
+
+	this.unhold()
+	this.cseq.set(mark)
+	this.marks = this.marks[:i]
+	this.updateMarked()
+	this.signal()
+	return nil
+}
+
+// Unmark releases mark without moving the consumer, e.g., once the frame is complete.
+// If mark isn't active, the error is ErrBufferInvalidMark.
+func (this *Buffer) Unmark(mark int64) error {
+	i := this.findMark(mark)
+	if i < 0 {
+		return ErrBufferInvalidMark
+	}
+
+	this.marks = append(this.marks[:i], this.marks[i+1:]...)
+	this.updateMarked()
+	this.signal()
+	return nil
+}
+
+// findMark returns the index of the latest active mark at position mark, or -1 if
+// there's none.
+func (this *Buffer) findMark(mark int64) int {
+	for i := len(this.marks) - 1; i >= 0; i-- {
+		if this.marks[i] == mark {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// updateMarked tells the producer where the oldest active mark is.
+func (this *Buffer) updateMarked() {
+	if len(this.marks) > 0 {
+		atomic.StoreInt64(&this.marked, this.marks[0])
+	} else {
+		atomic.StoreInt64(&this.marked, -1)
+	}
+}
+
+// ReadAt copies len(p) bytes, starting at position off in the stream, into p. It
+// doesn't move the cursor or wait for the producer. Since off is an absolute position,
+// like Produced and Consumed, ReadAt can look back at bytes that have been consumed, as
+// long as the producer hasn't overwritten them. If it has, ReadAt returns 0 and
+// ErrBufferOverwritten. If not all of the bytes have been written yet, it returns what
+// it could read and io.EOF. While ReadAt copies, the producer waits instead of
+// overwriting the bytes.
+func (this *Buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	ppos := this.pseq.get()
+
+	n := int64(len(p))
+	err := error(nil)
+
+	if off+n > ppos {
+		n = ppos - off
+		err = io.EOF
+	}
+
+	if n <= 0 {
+		return 0, err
+	}
+
+	this.pinmu.Lock()
+	defer this.pinmu.Unlock()
+
+	// Pin the bytes before checking whether they're still there. The producer checks
+	// for pins after moving its claim, so either we see its claim here, or it sees the
+	// pin and waits for us to be done copying.
+	this.pin(off)
+	defer this.unpin()
+
+	if off < this.pseq.getClaim()-this.size {
+		return 0, ErrBufferOverwritten
+	}
+
+	ringRead(p[:n], this.buf, off&this.mask)
+
+	return int(n), err
+}
+
+// pin keeps the producer from overwriting anything from off on, see ReadAt.
+func (this *Buffer) pin(off int64) {
+	root := this
+	if this.root != nil {
+		root = this.root
+	}
+
+	atomic.StoreInt64(&this.pinned, off)
+	atomic.AddInt32(&root.pins, 1)
+}
+
+// unpin lets the producer have back what pin kept from it.
+func (this *Buffer) unpin() {
+	root := this
+	if this.root != nil {
+		root = this.root
+	}
+
+	atomic.StoreInt64(&this.pinned, -1)
+	atomic.AddInt32(&root.pins, -1)
+	this.signal()
+}
+
+// Discard skips the next n bytes, waiting for the producer as needed, and returns the
+// number of bytes discarded. Unlike Commit, n can be more than what's in the buffer, or
+// even the buffer size. If Discard skips fewer than n bytes, it also returns an error.
+func (this *Buffer) Discard(n int) (int, error) {
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
+	this.unhold()
+
+	total := int64(0)
+
+	for total < int64(n) {
+		cpos := this.cseq.get()
+		ppos := this.barrier()
+
+		if cpos >= ppos {
+			if err := this.waitForData(context.Background(), cpos); err != nil {
+				return int(total), err
+			}
+
+			ppos = this.barrier()
+		}
+
+		m := ppos - cpos
+		if m > int64(n)-total {
+			m = int64(n) - total
+		}
+
+		this.cseq.set(cpos + m)
+		this.signal()
+
+		total += m
+	}
+
+	return n, nil
+}
+
+// ReadByte reads and returns a single byte, waiting for the producer if there is none.
+func (this *Buffer) ReadByte() (byte, error) {
+	this.unhold()
+
+	cpos := this.cseq.get()
+
+	if cpos >= this.barrier() {
+		if err := this.waitForData(context.Background(), cpos); err != nil {
+			return 0, err
+		}
+	}
+
+	c := this.buf[cpos&this.mask]
+
+	this.hold(cpos)
+	this.cseq.set(cpos + 1)
+	this.signal()
+
+	this.lastByte = int(c)
+	return c, nil
+}
+
+// UnreadByte unreads the last byte. Only the most recently read byte can be unread,
+// and only if nothing but ReadByte, ReadRune or ReadSlice moved the cursor since.
+func (this *Buffer) UnreadByte() error {
+	if this.lastByte < 0 {
+		return bufio.ErrInvalidUnreadByte
+	}
+
+	// The producer can't have overwritten the byte since we're still holding it
+	this.cseq.set(this.cseq.get() - 1)
+	this.unhold()
+	this.signal()
+	return nil
+}
+
+// ReadRune reads a single UTF-8 encoded Unicode character and returns the rune and its
+// size in bytes. If the encoded rune is invalid, it consumes one byte and returns
+// unicode.ReplacementChar (U+FFFD) with a size of 1.
+func (this *Buffer) ReadRune() (rune, int, error) {
+	this.unhold()
+
+	var (
+		p [utf8.UTFMax]byte
+		n int64
+	)
+
+	cpos := this.cseq.get()
+
+	// Wait until there's a full rune, or there won't be any more data
+	for {
+		ppos := this.barrier()
+
+		n = ppos - cpos
+		if n > utf8.UTFMax {
+			n = utf8.UTFMax
+		}
+
+		if n > 0 {
+			ringRead(p[:n], this.buf, cpos&this.mask)
+
+			if n == utf8.UTFMax || utf8.FullRune(p[:n]) {
+				break
+			}
+		}
+
+		if err := this.waitForData(context.Background(), ppos); err != nil {
+			if n == 0 {
+				return 0, 0, err
+			}
+
+			break
+		}
+	}
+
+	r, size := utf8.DecodeRune(p[:n])
+
+	this.hold(cpos)
+	this.cseq.set(cpos + int64(size))
+	this.signal()
+
+	this.lastByte = int(p[size-1])
+	this.lastRuneSize = size
+	return r, size, nil
+}
+
+// UnreadRune unreads the last rune. It only works if the last call that moved the
+// cursor was ReadRune.
+func (this *Buffer) UnreadRune() error {
+	if this.lastRuneSize < 0 {
+		return bufio.ErrInvalidUnreadRune
+	}
+
+	this.cseq.set(this.cseq.get() - int64(this.lastRuneSize))
+	this.unhold()
+	this.signal()
+	return nil
+}
+
+// Description below is copied from bufio.ReadSlice()
+//   http://golang.org/pkg/bufio/#Reader.ReadSlice
+// ReadSlice reads until the first occurrence of delim in the input, returning a slice
+// pointing at the bytes in the buffer. The bytes stop being valid at the next read,
+// and the producer can't overwrite them until then.
+// If ReadSlice encounters an error before finding a delimiter, it returns all the data
+// in the buffer and the error itself (often io.EOF). ReadSlice fails with error
+// bufio.ErrBufferFull if the buffer fills without a delim.
+// Data wrapping around the end of the buffer is copied into the same slice Peek uses.
+func (this *Buffer) ReadSlice(delim byte) ([]byte, error) {
+	this.unhold()
+
+	cpos := this.cseq.get()
+	next := cpos
+
+	for {
+		ppos := this.barrier()
+
+		if i := this.indexByte(next, ppos, delim); i >= 0 {
+			return this.readSlice(cpos, i+1-cpos), nil
+		}
+
+		if ppos-cpos >= this.size {
+			return this.readSlice(cpos, ppos-cpos), bufio.ErrBufferFull
+		}
+
+		// No need to look at these again
+		next = ppos
+
+		if err := this.waitForData(context.Background(), ppos); err != nil {
+			if ppos > cpos {
+				return this.readSlice(cpos, ppos-cpos), err
+			}
+
+			return nil, err
+		}
+	}
+}
+
+// ReadLine is the same as bufio.Reader.ReadLine. Most callers should use ReadBytes('\n')
+// or ReadString('\n') instead.
+func (this *Buffer) ReadLine() ([]byte, bool, error) {
+	return readLine(this)
+}
+
+// ReadBytes reads until the first occurrence of delim in the input, returning a new
+// slice containing the data up to and including the delimiter. If ReadBytes encounters
+// an error before finding a delimiter, it returns the data read before the error and
+// the error itself (often io.EOF).
+func (this *Buffer) ReadBytes(delim byte) ([]byte, error) {
+	return readBytes(this, delim)
+}
+
+// ReadString is like ReadBytes, but returns a string.
+func (this *Buffer) ReadString(delim byte) (string, error) {
+	p, err := readBytes(this, delim)
+	return string(p), err
+}
+
+// readSlice moves the cursor from cpos forward by n bytes, and returns them. The
+// consumer holds on to them until its next read, so the producer can't overwrite them.
+func (this *Buffer) readSlice(cpos, n int64) []byte {
+	var p []byte
+
+	cindex := cpos & this.mask
+
+	if cindex+n > this.size {
+		this.tmp = append(this.tmp[0:0], this.buf[cindex:]...)
+		this.tmp = append(this.tmp, this.buf[0:cindex+n-this.size]...)
+		p = this.tmp
+	} else {
+		p = this.buf[cindex : cindex+n]
+	}
+
+	this.hold(cpos)
+	this.cseq.set(cpos + n)
+	this.signal()
+
+	if n > 0 {
+		this.lastByte = int(p[n-1])
+	}
+
+	return p
+}
+
+// indexByte returns the position of the first c between positions start and end, or
+// -1 if there's none.
+func (this *Buffer) indexByte(start, end int64, c byte) int64 {
+	for start < end {
+		i := start & this.mask
+
+		j := i + end - start
+		if j > this.size {
+			j = this.size
+		}
+
+		if k := bytes.IndexByte(this.buf[i:j], c); k >= 0 {
+			return start + int64(k)
+		}
+
+		start += j - i
+	}
+
+	return -1
+}
+
+// hold keeps the producer from overwriting anything from cpos on, even after the
+// cursor moves past it. This way the consumer can still use the bytes it just read,
+// or unread them. It must be called before the cursor moves.
+func (this *Buffer) hold(cpos int64) {
+	atomic.StoreInt64(&this.held, cpos)
+}
+
+// unhold lets the producer have back whatever the consumer is holding on to. It's
+// called by everything that reads, since that invalidates what the last read returned.
+func (this *Buffer) unhold() {
+	if atomic.LoadInt64(&this.held) >= 0 {
+		atomic.StoreInt64(&this.held, -1)
+		this.signal()
+	}
+
+	this.lastByte = -1
+	this.lastRuneSize = -1
+}
+
+// released returns the position before which the consumer is done with the buffer, so
+// the producer can overwrite everything before it. For a BroadcastBuffer, that's the
+// position of the slowest consumer that's still attached.
+func (this *Buffer) released() int64 {
+	if readers, ok := this.readers.Load().([]*Buffer); ok {
+		cpos := this.pseq.get()
+
+		for _, r := range readers {
+			if atomic.LoadInt64(&r.done) == 1 {
+				continue
+			}
+
+			if c := r.released(); c < cpos {
+				cpos = c
+			}
+		}
+
+		return cpos
+	}
+
+	// Load the cursor first. The consumer holds on to bytes, or marks them, before
+	// moving the cursor, so if we see the new cursor we also see what's held.
+	cpos := this.cseq.get()
+
+	if held := atomic.LoadInt64(&this.held); held >= 0 && held < cpos {
+		cpos = held
+	}
+
+	if marked := atomic.LoadInt64(&this.marked); marked >= 0 && marked < cpos {
+		cpos = marked
+	}
+
+	if pinned := atomic.LoadInt64(&this.pinned); pinned >= 0 && pinned < cpos {
+		cpos = pinned
+	}
+
+	return cpos
+}
+
+func (this *Buffer) waitForWriteSpace(ctx context.Context, n int) (int64, int, error) {
+	// Any write drops what's left of a reservation, since this space may overlap it,
+	// and Publish must never move past space nobody waited for.
+	this.reserved = 0
+
+	if this.werr.get() != nil {
+		return 0, 0, io.ErrClosedPipe
+	}
+
+	// The current producer position, remember it's a forever inreasing int64,
+	// NOT the position relative to the buffer
+	ppos := this.pseq.get()
+
+	// The next producer position we will get to if we read the default block size
+	next := ppos + int64(n)
+
+	// For the producer, gate is the previous consumer sequence.
+	gate := this.pseq.gate
+
+	wrap := next - this.size
+
+	//glog.Debugf("ppos = %d, next = %d, gate = %d, wrap = %d", ppos, next, gate, wrap)
+
+	// If wrap point is greater than gate, that means the consumer hasn't read
+	// some of the data in the buffer, and if we read in additional data and put
+	// into the buffer, we would overwrite some of the unread data. It means we
+	// cannot do anything until the customers have passed it. So we wait...
+	//
+	// Let's say size = 16, block = 4, ppos = 0, gate = 0
+	//   then next = 4 (0+4), and wrap = -12 (4-16)
+	//   _______________________________________________________________________
+	//   | 0 | 1 | 2 | 3 | 4 | 5 | 6 | 7 | 8 | 9 | 10 | 11 | 12 | 13 | 14 | 15 |
+	//   -----------------------------------------------------------------------
+	//    ^                ^
+	//    ppos,            next
+	//    gate
+	//
+	// So wrap (-12) > gate (0) = false, and gate (0) > ppos (0) = false also,
+	// so we move on (no waiting)
+	//
+	// Now if we get to ppos = 14, gate = 12,
+	// then next = 18 (4+14) and wrap = 2 (18-16)
+	//
+	// So wrap (2) > gate (12) = false, and gate (12) > ppos (14) = false aos,
+	// so we move on again
+	//
+	// Now let's say we have ppos = 14, gate = 0 still (nothing read),
+	// then next = 18 (4+14) and wrap = 2 (18-16)
+	//
+	// So wrap (2) > gate (0) = true, which means we have to wait because if we
+	// put data into the slice to the wrap point, it would overwrite the 2 bytes
+	// that are currently unread.
+	//
+	// Another scenario, let's say ppos = 100, gate = 80,
+	// then next = 104 (100+4) and wrap = 88 (104-16)
+	//
+	// So wrap (88) > gate (80) = true, which means we have to wait because if we
+	// put data into the slice to the wrap point, it would overwrite the 8 bytes
+	// that are currently unread.
+	//
+	if wrap > gate || gate > ppos {
+		var cpos int64
+
+		//glog.Debugf("cpos = %d", cpos)
+		this.pwait++
+
+		err := this.wait(ctx, &this.wdeadline, func() bool {
+			cpos = this.released()
+			return wrap <= cpos
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		this.pseq.gate = cpos
+	}
+
+	// Let ReadAt know we may be overwriting data up to next-size from now on
+	this.pseq.setClaim(next)
+	this.waitUnpinned(next)
+
+	return ppos, n, nil
+}
+
+// waitUnpinned waits until ReadAt isn't copying any of the bytes the producer may
+// overwrite now that it has claimed up to end. It must be called after moving the
+// claim, since ReadAt pins the bytes before it looks at the claim. Either way round,
+// ReadAt doesn't copy for long, so this only waits briefly.
+func (this *Buffer) waitUnpinned(end int64) {
+	if atomic.LoadInt32(&this.pins) == 0 {
+		return
+	}
+
+	wrap := end - this.size
+
+	if wrap > this.released() {
+		this.waiter.Wait(func() bool {
+			return wrap <= this.released()
+		})
+	}
+}
+
+// waitForData waits until the barrier has moved past cpos, i.e., there's at least one
+// byte for the consumer to read. If there will never be any because the producer closed
+// the buffer for writing, it returns the error it was closed with, normally io.EOF.
+func (this *Buffer) waitForData(ctx context.Context, cpos int64) error {
+	err := this.wait(ctx, &this.rdeadline, func() bool {
+		return this.barrier() > cpos || this.closeErr() != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// If we got here because of CloseWithError, the data written before it is visible
+	// by now, so it's safe to check again.
+	if this.barrier() <= cpos {
+		return this.closeErr()
+	}
+
+	return nil
+}
+
+// Readable returns a channel that's closed once there's data to read, or the buffer is
+// closed, so the consumer can wait for the buffer in a select statement. If that's
+// already the case, the channel is closed right away. Each call returns a new channel
+// that fires once. Since data can go away before the consumer gets to it, e.g., in a
+// MultiConsumerBuffer, use TryRead after it fires.
+func (this *Buffer) Readable() <-chan struct{} {
+	return this.watch(&this.readable)
+}
+
+// Writable returns a channel that's closed once there's space to write, or the buffer
+// is closed, so the producer can wait for the buffer in a select statement. Like
+// Readable, each call returns a new channel that fires once. Use TryWrite after it
+// fires.
+func (this *Buffer) Writable() <-chan struct{} {
+	return this.watch(&this.writable)
+}
+
+// Done returns a channel that's closed once the buffer is closed, by either Close,
+// CloseWrite or CloseWithError. Every call returns the same channel.
+func (this *Buffer) Done() <-chan struct{} {
+	this.wmu.Lock()
+	if this.donech == nil {
+		this.donech = make(chan struct{})
+		atomic.AddInt32(&this.watchers, 1)
+	}
+	ch := this.donech
+	this.wmu.Unlock()
+
+	this.notify()
+	return ch
+}
+
+// OnHighWater registers fn to be called whenever Len() rises to threshold or above, e.g.,
+// to stop reading from a socket before the producer has to wait for buffer space. fn is
+// called by whoever made Len() cross the threshold, usually the producer, with a lock
+// held, so it must not block or use the buffer.
+func (this *Buffer) OnHighWater(threshold int, fn func()) {
+	this.addWatermark(threshold, true, fn)
+}
+
+// OnLowWater registers fn to be called whenever Len() falls to threshold or below, e.g.,
+// to resume reading once the consumer catches up. Like with OnHighWater, fn must not
+// block or use the buffer.
+func (this *Buffer) OnLowWater(threshold int, fn func()) {
+	this.addWatermark(threshold, false, fn)
+}
+
+func (this *Buffer) addWatermark(threshold int, high bool, fn func()) {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	this.hookmu.Lock()
+	defer this.hookmu.Unlock()
+
+	wmarks, _ := this.wmarks.Load().([]*watermark)
+	wmarks = append(wmarks[:len(wmarks):len(wmarks)], newWatermark(threshold, high, fn, this.buffered()))
+	this.wmarks.Store(wmarks)
+}
+
+// watch adds a new channel to list, and returns it. It's closed by notify.
+func (this *Buffer) watch(list *[]chan struct{}) <-chan struct{} {
+	ch := make(chan struct{})
+
+	this.wmu.Lock()
+	*list = append(*list, ch)
+	atomic.AddInt32(&this.watchers, 1)
+	this.wmu.Unlock()
+
+	// In case it's ready already. Otherwise, whoever changes that will see the watcher
+	// we just added.
+	this.notify()
+	return ch
+}
+
+// signal lets everyone waiting for the buffer know something changed, whether they're
+// in the WaitStrategy or waiting on one of the channels from Readable, Writable or Done.
+func (this *Buffer) signal() {
+	this.waiter.Signal()
+
+	// The buffers of a BroadcastBuffer and its consumers all depend on each other.
+	root := this
+	if this.root != nil {
+		root = this.root
+	}
+
+	root.notify()
+
+	if readers, ok := root.readers.Load().([]*Buffer); ok {
+		for _, r := range readers {
+			r.notify()
+		}
+	}
+}
+
+// notify calls the watermark hooks whose threshold has been crossed, and closes the
+// channels that are ready to fire. It's cheap if there are none.
+func (this *Buffer) notify() {
+	if wmarks, ok := this.wmarks.Load().([]*watermark); ok {
+		this.checkWatermarks(wmarks)
+	}
+
+	if atomic.LoadInt32(&this.watchers) == 0 {
+		return
+	}
+
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	closed := atomic.LoadInt64(&this.done) == 1 || this.werr.get() != nil
+
+	if len(this.readable) > 0 && (closed || this.buffered() > 0) {
+		fire(this.readable)
+		atomic.AddInt32(&this.watchers, -int32(len(this.readable)))
+		this.readable = nil
+	}
+
+	if len(this.writable) > 0 && (closed || this.space() > 0) {
+		fire(this.writable)
+		atomic.AddInt32(&this.watchers, -int32(len(this.writable)))
+		this.writable = nil
+	}
+
+	if this.donech != nil && closed {
+		select {
+		case <-this.donech:
+		default:
+			close(this.donech)
+			atomic.AddInt32(&this.watchers, -1)
+		}
+	}
+}
+
+// checkWatermarks calls the hooks in wmarks whose threshold has been crossed. Len() has
+// to be read under the lock. Otherwise, a check that read it before the producer and
+// consumer both moved could run last, and leave a hook stuck on the wrong side of its
+// threshold. The lock is released even if a hook panics, so the buffer keeps working.
+func (this *Buffer) checkWatermarks(wmarks []*watermark) {
+	this.hookmu.Lock()
+	defer this.hookmu.Unlock()
+
+	n := this.buffered()
+
+	for _, w := range wmarks {
+		w.check(n)
+	}
+}
+
+// buffered returns Len() as seen by the type that embeds the Buffer, see lenFn.
+func (this *Buffer) buffered() int {
+	if this.lenFn != nil {
+		return this.lenFn()
+	}
+
+	return this.Len()
+}
+
+// space returns Free() as seen by the type that embeds the Buffer, see freeFn.
+func (this *Buffer) space() int {
+	if this.freeFn != nil {
+		return this.freeFn()
+	}
+
+	return this.Free()
+}
+
+func fire(chans []chan struct{}) {
+	for _, ch := range chans {
+		close(ch)
+	}
+}
+
+// barrier returns the position up to which the consumer can read. That's the producer
+// position, except for a BroadcastConsumer that depends on other consumers, which can't
+// get ahead of anything they aren't done with yet. Detached consumers don't count.
+func (this *Buffer) barrier() int64 {
+	ppos := this.pseq.get()
+
+	for _, d := range this.deps {
+		if atomic.LoadInt64(&d.done) == 1 {
+			continue
+		}
+
+		if c := d.released(); c < ppos {
+			ppos = c
+		}
+	}
+
+	return ppos
+}
+
+// closeErr returns the error the producer closed the buffer with, or nil if it's still
+// open. For a consumer that depends on others, it stays nil until they are done with
+// everything the producer wrote, so the consumer doesn't stop short.
+func (this *Buffer) closeErr() error {
+	werr := this.werr.get()
+
+	if werr != nil && len(this.deps) > 0 && this.barrier() < this.pseq.get() {
+		return nil
+	}
+
+	return werr
+}
+
+// wait waits, the way the WaitStrategy does, until ready returns true. It returns io.EOF
+// if the buffer is closed, ctx.Err() if ctx is done, or ErrBufferTimeout if the deadline
+// passes, before that happens.
+func (this *Buffer) wait(ctx context.Context, deadline *int64, ready func() bool) error {
+	if ready() {
+		return nil
+	}
+
+	// A WaitStrategy that blocks can't wait on a channel or a timer, so we have someone
+	// else signal it when ctx is done or the deadline passes.
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-done:
+				this.signal()
+
+			case <-stop:
+			}
+		}()
+	}
+
+	var (
+		timer *time.Timer
+		armed int64
+		err   error
+	)
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	closed := waitOrDone(this.waiter, &this.done, func() bool {
+		if ready() {
+			return true
+		}
+
+		if err = ctx.Err(); err != nil {
+			return true
+		}
+
+		// The deadline may have been changed while we were waiting, in which case we
+		// were signaled and need to re-arm the timer.
+		if d := atomic.LoadInt64(deadline); d != 0 {
+			wait := time.Duration(d - time.Now().UnixNano())
+			if wait <= 0 {
+				err = ErrBufferTimeout
+				return true
+			}
+
+			if d != armed {
+				if timer != nil {
+					timer.Stop()
+				}
+
+				timer = time.AfterFunc(wait, this.waiter.Signal)
+				armed = d
+			}
+		}
+
+		return false
+	})
+	if closed != nil {
+		return closed
+	}
+
+	return err
+}
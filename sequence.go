@@ -25,8 +25,14 @@ type sequence struct {
 	// The previous known position of the consumer (if producer) or producer (if consumer)
 	gate,
 
+	// The position up to which the producer may be writing, i.e., the cursor plus the
+	// space it has claimed but not published yet. In a MultiProducerBuffer, producers
+	// compete for it with casClaim, and in a MultiConsumerBuffer, so do consumers for
+	// the data they read.
+	claim,
+
 	// These are fillers to pad the cache line, which is generally 64 bytes
-	p2, p3, p4, p5, p6, p7 int64
+	p3, p4, p5, p6, p7 int64
 }
 
 func newSequence() *sequence {
@@ -40,3 +46,19 @@ func (this *sequence) get() int64 {
 func (this *sequence) set(seq int64) {
 	atomic.StoreInt64(&this.cursor, seq)
 }
+
+func (this *sequence) cas(old, seq int64) bool {
+	return atomic.CompareAndSwapInt64(&this.cursor, old, seq)
+}
+
+func (this *sequence) getClaim() int64 {
+	return atomic.LoadInt64(&this.claim)
+}
+
+func (this *sequence) setClaim(seq int64) {
+	atomic.StoreInt64(&this.claim, seq)
+}
+
+func (this *sequence) casClaim(old, seq int64) bool {
+	return atomic.CompareAndSwapInt64(&this.claim, old, seq)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/dataence/bithacks"
+)
+
+// Ring is a ring buffer of values of type T, with one producer and one consumer. The
+// values are stored in slots allocated up front, and the producer and consumer move
+// through them with sequences the same way they move through the bytes of a Buffer,
+// so handing a value over doesn't allocate, or take a lock unless the WaitStrategy
+// does.
+type Ring[T any] struct {
+	slots []T
+
+	size int64
+	mask int64
+
+	done int64
+
+	pseq *sequence
+	cseq *sequence
+
+	// How the producer and consumer wait for each other
+	waiter WaitStrategy
+}
+
+// NewRing creates a Ring with size slots, which must be a power of two. If wait is nil,
+// it waits with a YieldingWait.
+func NewRing[T any](size int64, wait WaitStrategy) (*Ring[T], error) {
+	if size <= 0 || !bithacks.PowerOfTwo64(size) {
+		return nil, fmt.Errorf("Size must be power of two. Try %d.", bithacks.RoundUpPowerOfTwo64(size))
+	}
+
+	if wait == nil {
+		wait = NewYieldingWait()
+	}
+
+	return &Ring[T]{
+		slots:  make([]T, size),
+		size:   size,
+		mask:   size - 1,
+		pseq:   newSequence(),
+		cseq:   newSequence(),
+		waiter: wait,
+	}, nil
+}
+
+// Len returns the number of values waiting to be taken.
+func (this *Ring[T]) Len() int {
+	cpos := this.cseq.get()
+	ppos := this.pseq.get()
+	return int(ppos - cpos)
+}
+
+// Cap returns the number of slots.
+func (this *Ring[T]) Cap() int {
+	return int(this.size)
+}
+
+// Close closes the ring, like closing a channel. Put returns io.ErrClosedPipe after
+// that, and Take returns io.EOF once it has taken all the values that were put before.
+func (this *Ring[T]) Close() error {
+	atomic.StoreInt64(&this.done, 1)
+	this.waiter.Signal()
+	return nil
+}
+
+// Put adds v to the ring, waiting for the consumer to free up a slot if needed.
+func (this *Ring[T]) Put(v T) error {
+	ppos, _, err := this.space(1, true)
+	if err != nil {
+		return err
+	}
+
+	this.slots[ppos&this.mask] = v
+	this.publish(ppos + 1)
+	return nil
+}
+
+// TryPut is the non-blocking version of Put. If all the slots are taken, it returns
+// ErrBufferWouldBlock right away instead of waiting for the consumer.
+func (this *Ring[T]) TryPut(v T) error {
+	ppos, _, err := this.space(1, false)
+	if err != nil {
+		return err
+	}
+
+	this.slots[ppos&this.mask] = v
+	this.publish(ppos + 1)
+	return nil
+}
+
+// PutBatch adds all of vs to the ring, waiting for the consumer as needed, and returns
+// how many were added. Each time there are free slots, it fills as many as it can and
+// makes them visible to the consumer all at once.
+func (this *Ring[T]) PutBatch(vs []T) (int, error) {
+	total := 0
+
+	for total < len(vs) {
+		ppos, n, err := this.space(int64(len(vs)-total), true)
+		if err != nil {
+			return total, err
+		}
+
+		this.copyIn(ppos, vs[total:total+int(n)])
+		this.publish(ppos + n)
+
+		total += int(n)
+	}
+
+	return total, nil
+}
+
+// TryPutBatch is the non-blocking version of PutBatch. It adds as many of vs as there
+// are free slots for, and if that's less than len(vs), it also returns
+// ErrBufferWouldBlock.
+func (this *Ring[T]) TryPutBatch(vs []T) (int, error) {
+	if len(vs) == 0 {
+		return 0, nil
+	}
+
+	ppos, n, err := this.space(int64(len(vs)), false)
+	if err != nil {
+		return 0, err
+	}
+
+	this.copyIn(ppos, vs[:n])
+	this.publish(ppos + n)
+
+	if int(n) < len(vs) {
+		return int(n), ErrBufferWouldBlock
+	}
+
+	return int(n), nil
+}
+
+// Take removes and returns the next value, waiting for the producer if there is none.
+func (this *Ring[T]) Take() (T, error) {
+	var v T
+
+	cpos, _, err := this.data(1, true)
+	if err != nil {
+		return v, err
+	}
+
+	v = this.take(cpos)
+	this.release(cpos + 1)
+	return v, nil
+}
+
+// TryTake is the non-blocking version of Take. If there's no value, it returns
+// ErrBufferWouldBlock right away instead of waiting for the producer.
+func (this *Ring[T]) TryTake() (T, error) {
+	var v T
+
+	cpos, _, err := this.data(1, false)
+	if err != nil {
+		return v, err
+	}
+
+	v = this.take(cpos)
+	this.release(cpos + 1)
+	return v, nil
+}
+
+// TakeBatch fills vs with as many values as there are, up to len(vs), waiting for the
+// producer if there are none, and returns how many it took.
+func (this *Ring[T]) TakeBatch(vs []T) (int, error) {
+	if len(vs) == 0 {
+		return 0, nil
+	}
+
+	cpos, n, err := this.data(int64(len(vs)), true)
+	if err != nil {
+		return 0, err
+	}
+
+	this.copyOut(cpos, vs[:n])
+	this.release(cpos + n)
+	return int(n), nil
+}
+
+// TryTakeBatch is the non-blocking version of TakeBatch. If there's no value, it
+// returns ErrBufferWouldBlock right away instead of waiting for the producer.
+func (this *Ring[T]) TryTakeBatch(vs []T) (int, error) {
+	if len(vs) == 0 {
+		return 0, nil
+	}
+
+	cpos, n, err := this.data(int64(len(vs)), false)
+	if err != nil {
+		return 0, err
+	}
+
+	this.copyOut(cpos, vs[:n])
+	this.release(cpos + n)
+	return int(n), nil
+}
+
+// space makes sure there's at least one free slot, waiting for the consumer if block is
+// true, and returns the producer position and how many of max values fit.
+func (this *Ring[T]) space(max int64, block bool) (int64, int64, error) {
+	if atomic.LoadInt64(&this.done) == 1 {
+		return 0, 0, io.ErrClosedPipe
+	}
+
+	ppos := this.pseq.get()
+
+	// For the producer, gate is the previous consumer sequence. Only go look at the
+	// real one if the slots we know are free aren't enough.
+	free := this.pseq.gate + this.size - ppos
+	if free < max {
+		this.pseq.gate = this.cseq.get()
+		free = this.pseq.gate + this.size - ppos
+	}
+
+	if free == 0 {
+		if !block {
+			return 0, 0, ErrBufferWouldBlock
+		}
+
+		if err := this.wait(func() bool { return this.cseq.get()+this.size > ppos }); err != nil {
+			return 0, 0, io.ErrClosedPipe
+		}
+
+		this.pseq.gate = this.cseq.get()
+		free = this.pseq.gate + this.size - ppos
+	}
+
+	if free > max {
+		free = max
+	}
+
+	return ppos, free, nil
+}
+
+// data makes sure there's at least one value, waiting for the producer if block is
+// true, and returns the consumer position and how many of max values there are. Once
+// the ring is closed and all the values are taken, it returns io.EOF.
+func (this *Ring[T]) data(max int64, block bool) (int64, int64, error) {
+	// Check for close before looking at the data so anything put before Close is
+	// still taken.
+	done := atomic.LoadInt64(&this.done) == 1
+
+	cpos := this.cseq.get()
+
+	// For the consumer, gate is the previous producer sequence.
+	avail := this.cseq.gate - cpos
+	if avail < max {
+		this.cseq.gate = this.pseq.get()
+		avail = this.cseq.gate - cpos
+	}
+
+	if avail == 0 {
+		if done {
+			return 0, 0, io.EOF
+		}
+
+		if !block {
+			return 0, 0, ErrBufferWouldBlock
+		}
+
+		err := this.wait(func() bool { return this.pseq.get() > cpos })
+
+		this.cseq.gate = this.pseq.get()
+		avail = this.cseq.gate - cpos
+
+		if avail == 0 {
+			return 0, 0, err
+		}
+	}
+
+	if avail > max {
+		avail = max
+	}
+
+	return cpos, avail, nil
+}
+
+// wait waits until ready returns true, or returns io.EOF if the ring is closed before
+// that.
+func (this *Ring[T]) wait(ready func() bool) error {
+	return waitOrDone(this.waiter, &this.done, ready)
+}
+
+// publish makes everything up to ppos visible to the consumer.
+func (this *Ring[T]) publish(ppos int64) {
+	this.pseq.set(ppos)
+	this.waiter.Signal()
+}
+
+// release gives the slots up to cpos back to the producer.
+func (this *Ring[T]) release(cpos int64) {
+	this.cseq.set(cpos)
+	this.waiter.Signal()
+}
+
+// take returns the value at cpos, and clears the slot so it doesn't keep anything the
+// value points to from being garbage collected.
+func (this *Ring[T]) take(cpos int64) T {
+	var zero T
+
+	i := cpos & this.mask
+	v := this.slots[i]
+	this.slots[i] = zero
+	return v
+}
+
+// copyIn copies vs into the slots starting at ppos, wrapping around if needed.
+func (this *Ring[T]) copyIn(ppos int64, vs []T) {
+	n := copy(this.slots[ppos&this.mask:], vs)
+	copy(this.slots, vs[n:])
+}
+
+// copyOut copies the values starting at cpos into vs, wrapping around if needed, and
+// clears their slots, see take.
+func (this *Ring[T]) copyOut(cpos int64, vs []T) {
+	for i := range vs {
+		vs[i] = this.take(cpos + int64(i))
+	}
+}
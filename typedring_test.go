@@ -0,0 +1,181 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"io"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+type ringItem struct {
+	seq  int
+	name string
+}
+
+func TestRingPutTake(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			ring, err := NewRing[ringItem](64, wait)
+
+			assert.NoError(t, true, err)
+
+			// Busy spinning is slow on machines with a single CPU, so keep this short
+			n := 1000
+
+			go func() {
+				for i := 0; i < n; i++ {
+					assert.NoError(t, true, ring.Put(ringItem{seq: i, name: "item"}))
+				}
+
+				ring.Close()
+			}()
+
+			for i := 0; i < n; i++ {
+				v, err := ring.Take()
+
+				assert.NoError(t, true, err)
+				assert.Equal(t, true, i, v.seq)
+				assert.Equal(t, true, "item", v.name)
+			}
+
+			_, err = ring.Take()
+
+			assert.Equal(t, true, io.EOF, err)
+		})
+	}
+}
+
+func TestRingBatch(t *testing.T) {
+	ring, err := NewRing[int](64, nil)
+
+	assert.NoError(t, true, err)
+
+	n := 10000
+
+	go func() {
+		vs := make([]int, 100)
+
+		for i := 0; i < n; i += len(vs) {
+			for j := range vs {
+				vs[j] = i + j
+			}
+
+			m, err := ring.PutBatch(vs)
+
+			assert.NoError(t, true, err)
+			assert.Equal(t, true, len(vs), m)
+		}
+
+		ring.Close()
+	}()
+
+	vs := make([]int, 48)
+	next := 0
+
+	for {
+		m, err := ring.TakeBatch(vs)
+		if err == io.EOF {
+			break
+		}
+
+		assert.NoError(t, true, err)
+
+		for _, v := range vs[:m] {
+			assert.Equal(t, true, next, v)
+			next++
+		}
+	}
+
+	assert.Equal(t, true, n, next)
+}
+
+func TestRingTry(t *testing.T) {
+	ring, err := NewRing[string](4, nil)
+
+	assert.NoError(t, true, err)
+
+	_, err = NewRing[string](5, nil)
+
+	assert.Error(t, true, err)
+
+	_, err = ring.TryTake()
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+
+	m, err := ring.TryPutBatch([]string{"a", "b", "c"})
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 3, m)
+
+	assert.NoError(t, true, ring.TryPut("d"))
+	assert.Equal(t, true, ErrBufferWouldBlock, ring.TryPut("e"))
+	assert.Equal(t, true, 4, ring.Len())
+
+	v, err := ring.TryTake()
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "a", v)
+
+	// Only one slot is free, and the batch wraps around the end of the ring
+	m, err = ring.TryPutBatch([]string{"e", "f"})
+
+	assert.Equal(t, true, ErrBufferWouldBlock, err)
+	assert.Equal(t, true, 1, m)
+
+	vs := make([]string, 8)
+
+	m, err = ring.TryTakeBatch(vs)
+
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, []string{"b", "c", "d", "e"}, vs[:m])
+
+	ring.Close()
+
+	assert.Equal(t, true, io.ErrClosedPipe, ring.Put("g"))
+
+	_, err = ring.TryTake()
+
+	assert.Equal(t, true, io.EOF, err)
+}
+
+func BenchmarkRingPutTake(b *testing.B) {
+	ring, _ := NewRing[ringItem](1024, nil)
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			ring.Put(ringItem{seq: i})
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		ring.Take()
+	}
+}
+
+func BenchmarkChannelPutTake(b *testing.B) {
+	ch := make(chan ringItem, 1024)
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			ch <- ringItem{seq: i}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		<-ch
+	}
+}
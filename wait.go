@@ -0,0 +1,238 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WaitStrategy decides how the producer and consumer of a Buffer wait for each other,
+// e.g., for the consumer to make space, or for the producer to write data. The choice
+// trades latency for CPU cost.
+type WaitStrategy interface {
+	// Wait returns once ready returns true. It can call ready any number of times.
+	Wait(ready func() bool)
+
+	// Signal is called whenever something ready depends on may have changed, so a Wait
+	// that blocks knows to call ready again.
+	Signal()
+}
+
+var (
+	_ WaitStrategy = (*BusySpinWait)(nil)
+	_ WaitStrategy = (*YieldingWait)(nil)
+	_ WaitStrategy = (*SleepingWait)(nil)
+	_ WaitStrategy = (*BlockingWait)(nil)
+	_ WaitStrategy = (*PhasedBackoffWait)(nil)
+)
+
+// BusySpinWait calls ready in a tight loop. It has the lowest latency, but keeps a CPU
+// busy the whole time it waits, so it's only a good idea if there's a CPU to spare for
+// both the producer and the consumer.
+type BusySpinWait struct{}
+
+func NewBusySpinWait() *BusySpinWait {
+	return &BusySpinWait{}
+}
+
+func (this *BusySpinWait) Wait(ready func() bool) {
+	for !ready() {
+	}
+}
+
+func (this *BusySpinWait) Signal() {
+}
+
+// YieldingWait yields the processor between calls to ready, so other goroutines can run
+// while it waits. It still keeps a CPU busy if there's nothing else to run.
+type YieldingWait struct{}
+
+func NewYieldingWait() *YieldingWait {
+	return &YieldingWait{}
+}
+
+func (this *YieldingWait) Wait(ready func() bool) {
+	for !ready() {
+		runtime.Gosched()
+	}
+}
+
+func (this *YieldingWait) Signal() {
+}
+
+// SleepingWait yields the processor for a while, then sleeps between calls to ready. It
+// uses little CPU when the buffer is idle, at the cost of up to one sleep of latency.
+type SleepingWait struct {
+	// Number of times to yield before sleeping
+	yields int
+
+	sleep time.Duration
+}
+
+// NewSleepingWait creates a SleepingWait that sleeps for d at a time. If d is 0, it
+// sleeps for 100 microseconds.
+func NewSleepingWait(d time.Duration) *SleepingWait {
+	if d <= 0 {
+		d = 100 * time.Microsecond
+	}
+
+	return &SleepingWait{
+		yields: 100,
+		sleep:  d,
+	}
+}
+
+func (this *SleepingWait) Wait(ready func() bool) {
+	for i := 0; !ready(); i++ {
+		if i < this.yields {
+			runtime.Gosched()
+		} else {
+			time.Sleep(this.sleep)
+		}
+	}
+}
+
+func (this *SleepingWait) Signal() {
+}
+
+// BlockingWait parks the goroutine on a sync.Cond until it's signaled. It uses no CPU
+// while waiting, but waking up takes the longest. Signal only takes the lock when
+// someone is actually parked, so it's cheap when the other side keeps up.
+type BlockingWait struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Number of goroutines in Wait
+	waiters int32
+}
+
+func NewBlockingWait() *BlockingWait {
+	this := &BlockingWait{}
+	this.cond = sync.NewCond(&this.mu)
+	return this
+}
+
+func (this *BlockingWait) Wait(ready func() bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// Let Signal know we're here before calling ready. Whoever changes what ready
+	// depends on does so before checking waiters, so either we see the change, or
+	// Signal sees us.
+	atomic.AddInt32(&this.waiters, 1)
+	defer atomic.AddInt32(&this.waiters, -1)
+
+	for !ready() {
+		this.cond.Wait()
+	}
+}
+
+// Signal wakes up everyone waiting, if anyone is. The broadcast happens while holding
+// the lock, so it can't slip in between a waiter calling ready and going to sleep, and
+// be missed.
+func (this *BlockingWait) Signal() {
+	if atomic.LoadInt32(&this.waiters) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	this.cond.Broadcast()
+	this.mu.Unlock()
+}
+
+// PhasedBackoffWait spins for a while, then yields for a while, and then falls back to
+// another WaitStrategy, typically a BlockingWait. It gets the latency of spinning when
+// the other side is quick, without burning CPU when it isn't.
+type PhasedBackoffWait struct {
+	spin  time.Duration
+	yield time.Duration
+
+	fallback WaitStrategy
+}
+
+// NewPhasedBackoffWait creates a PhasedBackoffWait that spins for spin, yields for
+// yield, and then waits with fallback. If fallback is nil, it's a new BlockingWait.
+func NewPhasedBackoffWait(spin, yield time.Duration, fallback WaitStrategy) *PhasedBackoffWait {
+	if fallback == nil {
+		fallback = NewBlockingWait()
+	}
+
+	return &PhasedBackoffWait{
+		spin:     spin,
+		yield:    yield,
+		fallback: fallback,
+	}
+}
+
+func (this *PhasedBackoffWait) Wait(ready func() bool) {
+	var (
+		start    time.Time
+		yielding bool
+	)
+
+	for i := 0; !ready(); i++ {
+		if yielding {
+			runtime.Gosched()
+		}
+
+		// Looking at the clock costs more than calling ready, so only do it once in a
+		// while.
+		if i%100 != 0 {
+			continue
+		}
+
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		elapsed := time.Since(start)
+
+		if elapsed > this.spin+this.yield {
+			this.fallback.Wait(ready)
+			return
+		}
+
+		yielding = elapsed > this.spin
+	}
+}
+
+func (this *PhasedBackoffWait) Signal() {
+	this.fallback.Signal()
+}
+
+// waitOrDone waits with w until ready returns true, or returns io.EOF if done is set to
+// 1 before that, e.g., because the buffer or ring was closed.
+func waitOrDone(w WaitStrategy, done *int64, ready func() bool) error {
+	var err error
+
+	w.Wait(func() bool {
+		if ready() {
+			return true
+		}
+
+		if atomic.LoadInt64(done) == 1 {
+			err = io.EOF
+			return true
+		}
+
+		return false
+	})
+
+	return err
+}
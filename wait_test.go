@@ -0,0 +1,134 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func waitStrategies() map[string]WaitStrategy {
+	return map[string]WaitStrategy{
+		"BusySpin":      NewBusySpinWait(),
+		"Yielding":      NewYieldingWait(),
+		"Sleeping":      NewSleepingWait(time.Millisecond),
+		"Blocking":      NewBlockingWait(),
+		"PhasedBackoff": NewPhasedBackoffWait(time.Microsecond, time.Millisecond, nil),
+	}
+}
+
+func newWaitStrategyBuffer(t *testing.T, wait WaitStrategy) RingBuffer {
+	buf, err := NewRingBuffer(WithSize(4096), WithWaitStrategy(wait))
+
+	assert.NoError(t, true, err)
+
+	return buf
+}
+
+func TestWaitStrategyRead(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			testRead(t, newWaitStrategyBuffer(t, wait))
+		})
+	}
+}
+
+func TestWaitStrategyCloseWrite(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			testCloseWrite(t, newWaitStrategyBuffer(t, wait))
+		})
+	}
+}
+
+func TestWaitStrategyContext(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			testContext(t, newWaitStrategyBuffer(t, wait))
+		})
+	}
+}
+
+func TestWaitStrategyDeadline(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			testDeadline(t, newWaitStrategyBuffer(t, wait))
+		})
+	}
+}
+
+func TestWaitStrategyBroadcast(t *testing.T) {
+	for name, wait := range waitStrategies() {
+		t.Run(name, func(t *testing.T) {
+			buf, err := NewBroadcastBuffer(4096, WithWaitStrategy(wait))
+
+			assert.NoError(t, true, err)
+
+			c, err := buf.AddConsumer("c")
+
+			assert.NoError(t, true, err)
+			assert.Equal(t, true, wait, c.waiter)
+
+			go func() {
+				for i := 0; i < 100; i++ {
+					_, err := buf.Write(make([]byte, 1000))
+
+					assert.NoError(t, false, err)
+				}
+
+				buf.CloseWrite()
+			}()
+
+			n, err := c.WriteTo(io.Discard)
+
+			assert.Equal(t, true, io.EOF, err)
+			assert.Equal(t, true, int64(100000), n)
+		})
+	}
+}
+
+func TestBlockingWaitPingPong(t *testing.T) {
+	// Lots of tiny round trips, so any lost wakeup would leave both sides parked
+	ping, err := NewRingBuffer(WithSize(4096), WithWaitStrategy(NewBlockingWait()))
+
+	assert.NoError(t, true, err)
+
+	pong, err := NewRingBuffer(WithSize(4096), WithWaitStrategy(NewBlockingWait()))
+
+	assert.NoError(t, true, err)
+
+	n := 10000
+
+	go func() {
+		for i := 0; i < n; i++ {
+			c, err := ping.ReadByte()
+
+			assert.NoError(t, true, err)
+			assert.NoError(t, true, pong.WriteByte(c))
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		assert.NoError(t, true, ping.WriteByte(byte(i)))
+
+		c, err := pong.ReadByte()
+
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, byte(i), c)
+	}
+}
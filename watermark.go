@@ -0,0 +1,62 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ringbuffer2
+
+// watermark is a hook registered with OnHighWater or OnLowWater.
+type watermark struct {
+	threshold int
+	high      bool
+	fn        func()
+
+	// Whether Len() was last seen above the threshold, or at it for a high watermark.
+	// Guarded by the Buffer's hookmu, so each crossing calls fn once.
+	above bool
+}
+
+func newWatermark(threshold int, high bool, fn func(), n int) *watermark {
+	this := &watermark{
+		threshold: threshold,
+		high:      high,
+		fn:        fn,
+	}
+
+	// Only crossings count, so start from where Len() is now.
+	this.above = this.isAbove(n)
+
+	return this
+}
+
+func (this *watermark) isAbove(n int) bool {
+	if this.high {
+		return n >= this.threshold
+	}
+
+	return n > this.threshold
+}
+
+// check calls fn if n, the current Len(), has crossed the threshold in the direction
+// fn is waiting for. The caller must hold the Buffer's hookmu.
+func (this *watermark) check(n int) {
+	above := this.isAbove(n)
+	if above == this.above {
+		return
+	}
+
+	this.above = above
+
+	if above == this.high {
+		this.fn()
+	}
+}